@@ -0,0 +1,673 @@
+package actions
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	apiclient "docker-dashboard-agent/client"
+	"docker-dashboard-agent/compose"
+	"docker-dashboard-agent/docker"
+	"docker-dashboard-agent/policy"
+	"docker-dashboard-agent/signing"
+)
+
+// Result statuses reported in action_result messages.
+const (
+	StatusSuccess   = "SUCCESS"
+	StatusFailure   = "FAILURE"
+	StatusExpired   = "EXPIRED"
+	StatusDenied    = "DENIED"
+	StatusRejected  = "REJECTED"
+	StatusCancelled = "CANCELLED"
+)
+
+// progressInterval is how often a still-running action reports that it is
+// alive.
+const progressInterval = 5 * time.Second
+
+// StopParams applies to STOP and RESTART. Timeout is the grace period in
+// seconds before the container is killed; nil uses containers.stop_timeout.
+type StopParams struct {
+	Timeout *int `json:"timeout"`
+}
+
+// KillParams applies to KILL. Signal is a name ("SIGHUP") or number ("9");
+// empty sends SIGKILL.
+type KillParams struct {
+	Signal Signal `json:"signal"`
+}
+
+// RemoveParams applies to REMOVE.
+type RemoveParams struct {
+	Force   bool `json:"force"`
+	Volumes bool `json:"volumes"`
+}
+
+// UpdateParams applies to UPDATE. Force recreates the container even when
+// the pull found no newer image. HealthTimeout is how long, in seconds, the
+// new container may take to become healthy before the update is rolled
+// back; nil uses the default of 60 seconds.
+type UpdateParams struct {
+	Force         bool `json:"force"`
+	StopTimeout   *int `json:"stop_timeout"`
+	HealthTimeout *int `json:"health_timeout"`
+}
+
+// ProjectParams applies to PROJECT_START, PROJECT_STOP and PROJECT_RESTART.
+// Timeout is the per-container stop grace period in seconds. HealthTimeout
+// bounds the wait for a service_healthy dependency before its dependents
+// are started.
+type ProjectParams struct {
+	Timeout       *int `json:"timeout"`
+	HealthTimeout *int `json:"health_timeout"`
+}
+
+const defaultHealthTimeout = 60 * time.Second
+
+// Signal accepts both {"signal": "SIGHUP"} and {"signal": 1}.
+type Signal string
+
+func (s *Signal) UnmarshalJSON(data []byte) error {
+	if n, err := strconv.Atoi(string(data)); err == nil {
+		*s = Signal(strconv.Itoa(n))
+		return nil
+	}
+	unquoted, err := strconv.Unquote(string(data))
+	if err != nil {
+		return fmt.Errorf("signal must be a string or number")
+	}
+	*s = Signal(unquoted)
+	return nil
+}
+
+// Executor runs container actions. The cloud may redeliver an action after
+// a reconnect, so results are remembered for dedupeTTL and a repeated
+// request gets the original result back instead of running again.
+type Executor struct {
+	docker    *docker.Client
+	dedupeTTL time.Duration
+
+	// OnProgress, if set, receives intermediate progress of long-running
+	// actions such as UPDATE.
+	OnProgress func(apiclient.ActionProgress)
+
+	// Inventory returns the current containers; PROJECT_* actions resolve
+	// their project from it.
+	Inventory func() []apiclient.ContainerSnapshot
+
+	// Policy restricts which actions may run. Nil only enforces the
+	// protected label.
+	Policy *policy.Policy
+
+	// Verifier, if set, rejects every action whose signature does not
+	// verify.
+	Verifier *signing.Verifier
+
+	mu      sync.Mutex
+	seen    map[string]*execution
+	running map[string]*execution // by action ID
+}
+
+type execution struct {
+	action    string
+	done      chan struct{}
+	result    apiclient.ActionResult
+	finished  time.Time
+	cancel    context.CancelFunc
+	cancelled bool
+}
+
+func NewExecutor(dockerCli *docker.Client, dedupeTTL time.Duration) *Executor {
+	return &Executor{
+		docker:    dockerCli,
+		dedupeTTL: dedupeTTL,
+		seen:      make(map[string]*execution),
+		running:   make(map[string]*execution),
+	}
+}
+
+// Cancel aborts the running action named by req.ActionId through its
+// context. It reports whether such an action was running and can be
+// interrupted; a cancel that is not honoured is answered with a
+// cancel_rejected progress message so the cloud knows the action carries
+// on. When signing is enabled the cancel request must be signed like an
+// action whose Action is "CANCEL".
+func (e *Executor) Cancel(req apiclient.ActionRequest) bool {
+	req.Action = "CANCEL"
+	if e.Verifier != nil {
+		if err := e.Verifier.Verify(req); err != nil {
+			log.Printf("Rejected cancel of action %s: %v", req.ActionId, err)
+			e.progress(req, "cancel_rejected", "signature verification failed: "+err.Error(), 0, 0)
+			return false
+		}
+	}
+
+	e.mu.Lock()
+	ex, ok := e.running[req.ActionId]
+	var reason string
+	switch {
+	case !ok:
+		reason = "action is not running"
+	case !interruptible(ex.action):
+		reason = ex.action + " cannot be interrupted"
+	default:
+		ex.cancelled = true
+		ex.cancel()
+	}
+	e.mu.Unlock()
+
+	if reason != "" {
+		e.progress(req, "cancel_rejected", reason, 0, 0)
+		return false
+	}
+	return true
+}
+
+// Handle runs req once per idempotency key. A duplicate that arrives while
+// the first execution is still running waits for it and shares its result.
+func (e *Executor) Handle(ctx context.Context, req apiclient.ActionRequest) apiclient.ActionResult {
+	// Authenticate before touching the dedupe cache so that a forged
+	// envelope cannot claim the idempotency key of a genuine one. The nonce
+	// is only consumed by a new execution: a redelivered copy of an envelope
+	// carries the same nonce and must get the cached result.
+	if e.Verifier == nil {
+		return e.handle(ctx, req, nil)
+	}
+	if err := e.Verifier.Authenticate(req); err != nil {
+		return e.rejected(req, err)
+	}
+	return e.handle(ctx, req, func() error {
+		return e.Verifier.Consume(req)
+	})
+}
+
+func (e *Executor) rejected(req apiclient.ActionRequest, err error) apiclient.ActionResult {
+	log.Printf("Rejected %s on %s (action %s): %v", req.Action, target(req), req.ActionId, err)
+	result := failure(req, fmt.Errorf("signature verification failed: %w", err))
+	result.Status = StatusRejected
+	return result
+}
+
+// RunLocal runs an action the agent decided on itself, such as a scheduled
+// restart. It skips signature verification but is still subject to the
+// policy, and the result carries origin.
+func (e *Executor) RunLocal(ctx context.Context, req apiclient.ActionRequest, origin string) apiclient.ActionResult {
+	result := e.handle(ctx, req, nil)
+	result.Origin = origin
+	return result
+}
+
+// handle runs req unless its key was seen before. admit, if set, is called
+// before a new execution starts and can still refuse it.
+func (e *Executor) handle(ctx context.Context, req apiclient.ActionRequest, admit func() error) apiclient.ActionResult {
+	key := req.IdempotencyKey
+	if key == "" {
+		key = req.ActionId
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	if key == "" {
+		if admit != nil {
+			if err := admit(); err != nil {
+				return e.rejected(req, err)
+			}
+		}
+		return e.execute(ctx, req)
+	}
+
+	e.mu.Lock()
+	e.prune(time.Now())
+	if prev, ok := e.seen[key]; ok {
+		e.mu.Unlock()
+		select {
+		case <-prev.done:
+		case <-ctx.Done():
+			return failure(req, ctx.Err())
+		}
+		result := prev.result
+		result.ActionId = req.ActionId
+		result.Duplicate = true
+		return result
+	}
+	if admit != nil {
+		if err := admit(); err != nil {
+			e.mu.Unlock()
+			return e.rejected(req, err)
+		}
+	}
+	current := &execution{action: req.Action, done: make(chan struct{}), cancel: cancel}
+	e.seen[key] = current
+	e.running[req.ActionId] = current
+	e.mu.Unlock()
+
+	result := e.execute(ctx, req)
+
+	e.mu.Lock()
+	// An action that finished before the cancel took effect keeps its
+	// real outcome.
+	if current.cancelled && result.Status == StatusFailure && ctx.Err() != nil {
+		result.Status = StatusCancelled
+		result.Error = "cancelled: " + result.Error
+	}
+	current.result = result
+	current.finished = time.Now()
+	delete(e.running, req.ActionId)
+	close(current.done)
+	e.mu.Unlock()
+	return result
+}
+
+// prune forgets executions that finished more than dedupeTTL ago. The
+// caller must hold e.mu.
+func (e *Executor) prune(now time.Time) {
+	for key, ex := range e.seen {
+		if !ex.finished.IsZero() && now.Sub(ex.finished) > e.dedupeTTL {
+			delete(e.seen, key)
+		}
+	}
+}
+
+func (e *Executor) execute(ctx context.Context, req apiclient.ActionRequest) apiclient.ActionResult {
+	started := time.Now()
+
+	if req.Version > apiclient.ActionVersion {
+		return failure(req, fmt.Errorf("unsupported action version %d (agent supports up to %d)", req.Version, apiclient.ActionVersion))
+	}
+	if req.ExpiresAt != nil && started.After(*req.ExpiresAt) {
+		result := failure(req, fmt.Errorf("action expired at %s", req.ExpiresAt.Format(time.RFC3339)))
+		result.Status = StatusExpired
+		return result
+	}
+
+	decision, containerId, err := e.Authorize(ctx, req)
+	if err != nil {
+		return failure(req, fmt.Errorf("failed to evaluate action policy: %w", err))
+	}
+	if !decision.Allowed {
+		log.Printf("Denied %s on %s by policy rule %q", req.Action, target(req), decision.Rule)
+		result := failure(req, fmt.Errorf("denied by policy rule %q", decision.Rule))
+		result.Status = StatusDenied
+		result.Rule = decision.Rule
+		return result
+	}
+	// Act on the container the policy was checked against, not on whatever
+	// the reference may resolve to by now.
+	req.ContainerId = containerId
+
+	result := apiclient.ActionResult{
+		ActionId:    req.ActionId,
+		Action:      req.Action,
+		ContainerId: req.ContainerId,
+		Project:     req.Project,
+	}
+	stopTicker := e.tickProgress(req, started)
+	details, err := e.run(ctx, req)
+	stopTicker()
+	result.Details = details
+	if err != nil {
+		result.Status = StatusFailure
+		result.Error = err.Error()
+	} else {
+		result.Status = StatusSuccess
+	}
+
+	// Report where the container ended up so the cloud does not have to wait
+	// for the next inventory sync to show it. UPDATE may have replaced it.
+	stateId := req.ContainerId
+	if id, ok := details["containerId"].(string); ok && id != "" {
+		stateId = id
+	}
+	if stateId != "" {
+		// The action may have been cancelled; the state is still worth
+		// reporting.
+		if state, stateErr := e.docker.ContainerState(context.WithoutCancel(ctx), stateId); stateErr == nil {
+			result.State = state
+		}
+	}
+	result.DurationMs = time.Since(started).Milliseconds()
+	return result
+}
+
+// Authorize evaluates the policy for every container req would affect: the
+// named container, or each container of a project. The first denial wins.
+// The container may be named by full ID, short ID or name; Authorize
+// returns its full ID, which the action must then use. A container that
+// cannot be found is denied, since no rule could be checked against it.
+func (e *Executor) Authorize(ctx context.Context, req apiclient.ActionRequest) (policy.Decision, string, error) {
+	var targets []policy.Target
+	if req.Project != "" && e.Inventory != nil {
+		containers := e.Inventory()
+		inventory := make(map[string]apiclient.ContainerSnapshot, len(containers))
+		for _, c := range containers {
+			inventory[c.DockerId] = c
+		}
+		if project, ok := compose.Find(compose.Projects(containers), req.Project); ok {
+			for _, s := range project.Services {
+				for _, id := range s.Containers {
+					c := inventory[id]
+					labels := make(map[string]string, len(c.Labels))
+					for k, v := range c.Labels {
+						if s, ok := v.(string); ok {
+							labels[k] = s
+						}
+					}
+					targets = append(targets, policy.Target{Name: c.Name, Image: c.Image, Labels: labels})
+				}
+			}
+		}
+	}
+
+	containerId := req.ContainerId
+	if req.ContainerId != "" {
+		resolved, err := e.docker.ResolveContainer(ctx, req.ContainerId)
+		if err != nil {
+			return policy.Decision{}, "", err
+		}
+		if resolved == nil {
+			return policy.Decision{Allowed: false, Rule: policy.UnknownContainerRule}, "", nil
+		}
+		containerId = resolved.Id
+		targets = append(targets, policy.Target{Name: resolved.Name, Image: resolved.Image, Labels: resolved.Labels})
+	}
+
+	decision := e.Policy.Evaluate(req.Action, policy.Target{})
+	for _, t := range targets {
+		decision = e.Policy.Evaluate(req.Action, t)
+		if !decision.Allowed {
+			return decision, containerId, nil
+		}
+	}
+	return decision, containerId, nil
+}
+
+// interruptible reports whether cancelling action can stop it part way.
+// UPDATE gives up during its pull or health wait and restores the old
+// container; project actions stop between containers. The other actions
+// are single Docker calls the daemon carries through even if the request is
+// aborted, so cancelling them would only misreport the outcome.
+func interruptible(action string) bool {
+	switch action {
+	case "UPDATE", "PROJECT_START", "PROJECT_STOP", "PROJECT_RESTART":
+		return true
+	}
+	return false
+}
+
+func target(req apiclient.ActionRequest) string {
+	if req.Project != "" {
+		return "project " + req.Project
+	}
+	return "container " + req.ContainerId
+}
+
+func (e *Executor) run(ctx context.Context, req apiclient.ActionRequest) (map[string]interface{}, error) {
+	switch req.Action {
+	case "START":
+		return nil, e.docker.StartContainer(ctx, req.ContainerId)
+	case "STOP", "RESTART":
+		var params StopParams
+		if err := req.DecodeParams(&params); err != nil {
+			return nil, err
+		}
+		timeout, err := seconds("timeout", params.Timeout)
+		if err != nil {
+			return nil, err
+		}
+		e.progress(req, "stop", fmt.Sprintf("Stopping with a %s grace period", e.docker.StopGrace(timeout)), 0, 0)
+		if req.Action == "STOP" {
+			return nil, e.docker.StopContainer(ctx, req.ContainerId, timeout)
+		}
+		return nil, e.docker.RestartContainer(ctx, req.ContainerId, timeout)
+	case "PAUSE":
+		return nil, e.docker.PauseContainer(ctx, req.ContainerId)
+	case "UNPAUSE":
+		return nil, e.docker.UnpauseContainer(ctx, req.ContainerId)
+	case "KILL":
+		var params KillParams
+		if err := req.DecodeParams(&params); err != nil {
+			return nil, err
+		}
+		signal := string(params.Signal)
+		if signal == "" {
+			signal = "SIGKILL"
+		}
+		return map[string]interface{}{"signal": signal}, e.docker.KillContainer(ctx, req.ContainerId, signal)
+	case "REMOVE":
+		var params RemoveParams
+		if err := req.DecodeParams(&params); err != nil {
+			return nil, err
+		}
+		details := map[string]interface{}{"force": params.Force, "volumes": params.Volumes}
+		return details, e.docker.RemoveContainer(ctx, req.ContainerId, params.Force, params.Volumes)
+	case "UPDATE":
+		return e.update(ctx, req)
+	case "PROJECT_START", "PROJECT_STOP", "PROJECT_RESTART":
+		return e.project(ctx, req)
+	default:
+		return nil, fmt.Errorf("unknown action: %s", req.Action)
+	}
+}
+
+func (e *Executor) update(ctx context.Context, req apiclient.ActionRequest) (map[string]interface{}, error) {
+	var params UpdateParams
+	if err := req.DecodeParams(&params); err != nil {
+		return nil, err
+	}
+	stopTimeout, err := seconds("stop_timeout", params.StopTimeout)
+	if err != nil {
+		return nil, err
+	}
+	healthTimeout := defaultHealthTimeout
+	if params.HealthTimeout != nil {
+		if *params.HealthTimeout <= 0 {
+			return nil, fmt.Errorf("health_timeout must be greater than zero")
+		}
+		healthTimeout = time.Duration(*params.HealthTimeout) * time.Second
+	}
+
+	updated, err := e.docker.UpdateContainer(ctx, req.ContainerId, docker.UpdateOptions{
+		Force:         params.Force,
+		StopTimeout:   stopTimeout,
+		HealthTimeout: healthTimeout,
+	}, func(stage, message string, current, total int64) {
+		e.progress(req, stage, message, current, total)
+	})
+	if updated == nil {
+		return nil, err
+	}
+	details := map[string]interface{}{
+		"image":           updated.Image,
+		"previousImageId": updated.PreviousImageId,
+		"imageId":         updated.ImageId,
+		"updated":         updated.Updated,
+		"rolledBack":      updated.RolledBack,
+		"containerId":     updated.ContainerId,
+	}
+	if updated.PreviousId != "" {
+		details["previousContainerId"] = updated.PreviousId
+	}
+	return details, err
+}
+
+// project runs a Compose project action. Services are started in
+// depends_on order and stopped in reverse, so RESTART stops everything
+// before starting it again, like `docker compose restart`. A start stops at
+// the first failure since later services may depend on it; a stop carries
+// on and reports every failure. Cancelling ctx stops the action between
+// containers or during a health wait, never in the middle of a Docker call.
+func (e *Executor) project(ctx context.Context, req apiclient.ActionRequest) (map[string]interface{}, error) {
+	if req.Project == "" {
+		return nil, fmt.Errorf("project is required for %s", req.Action)
+	}
+	if e.Inventory == nil {
+		return nil, fmt.Errorf("container inventory is not available")
+	}
+	var params ProjectParams
+	if err := req.DecodeParams(&params); err != nil {
+		return nil, err
+	}
+	stopTimeout, err := seconds("timeout", params.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	healthTimeout := defaultHealthTimeout
+	if params.HealthTimeout != nil {
+		if *params.HealthTimeout <= 0 {
+			return nil, fmt.Errorf("health_timeout must be greater than zero")
+		}
+		healthTimeout = time.Duration(*params.HealthTimeout) * time.Second
+	}
+
+	project, ok := compose.Find(compose.Projects(e.Inventory()), req.Project)
+	if !ok {
+		return nil, fmt.Errorf("project %s not found", req.Project)
+	}
+	order, err := compose.StartOrder(project)
+	if err != nil {
+		return nil, err
+	}
+	services := make(map[string]apiclient.ServiceSnapshot, len(order))
+	for _, s := range order {
+		services[s.Name] = s
+	}
+
+	// Each step runs to completion once started; see interruptible.
+	stepCtx := context.WithoutCancel(ctx)
+
+	var steps []map[string]interface{}
+	record := func(service, containerId, op string, err error) {
+		step := map[string]interface{}{"service": service, "containerId": containerId, "op": op, "status": StatusSuccess}
+		if err != nil {
+			step["status"] = StatusFailure
+			step["error"] = err.Error()
+		}
+		steps = append(steps, step)
+	}
+
+	stopAll := func() error {
+		var failed []string
+		for i := len(order) - 1; i >= 0; i-- {
+			s := order[i]
+			e.progress(req, "stop", "Stopping service "+s.Name, 0, 0)
+			for _, id := range s.Containers {
+				if err := ctx.Err(); err != nil {
+					return err
+				}
+				err := e.docker.StopContainer(stepCtx, id, stopTimeout)
+				record(s.Name, id, "stop", err)
+				if err != nil {
+					failed = append(failed, s.Name)
+				}
+			}
+		}
+		if len(failed) > 0 {
+			return fmt.Errorf("failed to stop services: %s", strings.Join(failed, ", "))
+		}
+		return nil
+	}
+
+	startAll := func() error {
+		for _, s := range order {
+			for _, dep := range s.DependsOn {
+				depService, ok := services[dep.Service]
+				if !ok || dep.Condition != "service_healthy" {
+					continue
+				}
+				e.progress(req, "healthcheck", fmt.Sprintf("Waiting for %s before starting %s", dep.Service, s.Name), 0, 0)
+				for _, id := range depService.Containers {
+					if err := e.docker.WaitHealthy(ctx, id, healthTimeout); err != nil {
+						return fmt.Errorf("dependency %s of %s is not healthy: %w", dep.Service, s.Name, err)
+					}
+				}
+			}
+
+			e.progress(req, "start", "Starting service "+s.Name, 0, 0)
+			for _, id := range s.Containers {
+				if err := ctx.Err(); err != nil {
+					return err
+				}
+				err := e.docker.StartContainer(stepCtx, id)
+				record(s.Name, id, "start", err)
+				if err != nil {
+					return fmt.Errorf("failed to start service %s: %w", s.Name, err)
+				}
+			}
+		}
+		return nil
+	}
+
+	switch req.Action {
+	case "PROJECT_START":
+		err = startAll()
+	case "PROJECT_STOP":
+		err = stopAll()
+	case "PROJECT_RESTART":
+		if err = stopAll(); err == nil {
+			err = startAll()
+		}
+	}
+	return map[string]interface{}{"project": project.Name, "steps": steps}, err
+}
+
+// tickProgress reports every progressInterval that req is still running,
+// until the returned function is called.
+func (e *Executor) tickProgress(req apiclient.ActionRequest, started time.Time) func() {
+	if e.OnProgress == nil {
+		return func() {}
+	}
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(progressInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				elapsed := time.Since(started).Round(time.Second)
+				e.progress(req, "running", fmt.Sprintf("Still running after %s", elapsed), 0, 0)
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+func (e *Executor) progress(req apiclient.ActionRequest, stage, message string, current, total int64) {
+	if e.OnProgress == nil {
+		return
+	}
+	e.OnProgress(apiclient.ActionProgress{
+		ActionId: req.ActionId,
+		Stage:    stage,
+		Message:  message,
+		Current:  current,
+		Total:    total,
+	})
+}
+
+// seconds converts an optional whole-second param into a duration.
+func seconds(name string, value *int) (*time.Duration, error) {
+	if value == nil {
+		return nil, nil
+	}
+	if *value < 0 {
+		return nil, fmt.Errorf("%s must not be negative", name)
+	}
+	d := time.Duration(*value) * time.Second
+	return &d, nil
+}
+
+func failure(req apiclient.ActionRequest, err error) apiclient.ActionResult {
+	return apiclient.ActionResult{
+		ActionId:    req.ActionId,
+		Action:      req.Action,
+		ContainerId: req.ContainerId,
+		Status:      StatusFailure,
+		Error:       err.Error(),
+	}
+}
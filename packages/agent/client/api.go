@@ -2,16 +2,24 @@ package client
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"time"
 )
 
 type APIClient struct {
-	BaseURL    string
-	AgentToken string
-	HTTPClient *http.Client
+	BaseURL        string
+	AgentToken     string
+	HTTPClient     *http.Client
+	EnrollPath     string
+	HeartbeatPath  string
+	ContainersPath string
+	RetryAttempts  int
+	RetryDelay     time.Duration
 }
 
 func NewAPIClient(baseURL string, agentToken string) *APIClient {
@@ -21,9 +29,74 @@ func NewAPIClient(baseURL string, agentToken string) *APIClient {
 		HTTPClient: &http.Client{
 			Timeout: 10 * time.Second,
 		},
+		EnrollPath:     "/api/agent/enroll",
+		HeartbeatPath:  "/api/agent/heartbeat",
+		ContainersPath: "/api/agent/containers",
+		RetryAttempts:  3,
+		RetryDelay:     5 * time.Second,
 	}
 }
 
+// StatusError reports a non-2xx response from the Cloud API.
+type StatusError struct {
+	Op         string
+	StatusCode int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%s request failed with status: %d", e.Op, e.StatusCode)
+}
+
+// IsUnauthorized reports whether err means the cloud rejected the agent's
+// credentials.
+func IsUnauthorized(err error) bool {
+	var statusErr *StatusError
+	if !errors.As(err, &statusErr) {
+		return false
+	}
+	return statusErr.StatusCode == http.StatusUnauthorized || statusErr.StatusCode == http.StatusForbidden
+}
+
+// do sends the request built by newReq, retrying transport errors and 5xx
+// responses up to RetryAttempts more times. newReq is called once per attempt
+// so request bodies are never reused. Cancelling ctx aborts both the request
+// and the wait between attempts.
+func (c *APIClient) do(ctx context.Context, newReq func(ctx context.Context) (*http.Request, error)) (*http.Response, error) {
+	var lastErr error
+	for attempt := 0; attempt <= c.RetryAttempts; attempt++ {
+		if attempt > 0 {
+			timer := time.NewTimer(c.RetryDelay)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return nil, ctx.Err()
+			case <-timer.C:
+			}
+		}
+
+		req, err := newReq(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create request: %w", err)
+		}
+
+		resp, err := c.HTTPClient.Do(req)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, err
+			}
+			lastErr = err
+			continue
+		}
+		if resp.StatusCode >= 500 && attempt < c.RetryAttempts {
+			resp.Body.Close()
+			lastErr = fmt.Errorf("status %d", resp.StatusCode)
+			continue
+		}
+		return resp, nil
+	}
+	return nil, lastErr
+}
+
 type EnrollRequest struct {
 	Token         string `json:"token"`
 	Name          string `json:"name"`
@@ -39,28 +112,29 @@ type EnrollResponse struct {
 	OrganizationId string `json:"organizationId"`
 }
 
-func (c *APIClient) Enroll(reqData EnrollRequest) (*EnrollResponse, error) {
-	url := fmt.Sprintf("%s/api/agent/enroll", c.BaseURL)
-	
+func (c *APIClient) Enroll(ctx context.Context, reqData EnrollRequest) (*EnrollResponse, error) {
+	url := c.BaseURL + c.EnrollPath
+
 	bodyData, err := json.Marshal(reqData)
 	if err != nil {
 		return nil, fmt.Errorf("failed to marshal enroll request: %w", err)
 	}
 
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(bodyData))
-	if err != nil {
-		return nil, fmt.Errorf("failed to create request: %w", err)
-	}
-	req.Header.Set("Content-Type", "application/json")
-
-	resp, err := c.HTTPClient.Do(req)
+	resp, err := c.do(ctx, func(ctx context.Context) (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(bodyData))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		return req, nil
+	})
 	if err != nil {
 		return nil, fmt.Errorf("enroll request failed: %w", err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		return nil, fmt.Errorf("enroll request failed with status: %d", resp.StatusCode)
+		return nil, &StatusError{Op: "enroll", StatusCode: resp.StatusCode}
 	}
 
 	var enrollResp EnrollResponse
@@ -73,68 +147,114 @@ func (c *APIClient) Enroll(reqData EnrollRequest) (*EnrollResponse, error) {
 	return &enrollResp, nil
 }
 
-func (c *APIClient) Heartbeat() error {
+func (c *APIClient) Heartbeat(ctx context.Context) error {
 	if c.AgentToken == "" {
 		return fmt.Errorf("agent token is required for heartbeat")
 	}
 
-	url := fmt.Sprintf("%s/api/agent/heartbeat", c.BaseURL)
-	req, err := http.NewRequest("POST", url, nil)
-	if err != nil {
-		return fmt.Errorf("failed to create request: %w", err)
-	}
-
-	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", c.AgentToken))
-
-	resp, err := c.HTTPClient.Do(req)
+	url := c.BaseURL + c.HeartbeatPath
+	resp, err := c.do(ctx, func(ctx context.Context) (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, "POST", url, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", c.AgentToken))
+		return req, nil
+	})
 	if err != nil {
 		return fmt.Errorf("heartbeat request failed: %w", err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		return fmt.Errorf("heartbeat request failed with status: %d", resp.StatusCode)
+		return &StatusError{Op: "heartbeat", StatusCode: resp.StatusCode}
 	}
 
 	return nil
 }
 
 type ContainerSnapshot struct {
-	DockerId  string                 `json:"dockerId"`
-	Name      string                 `json:"name"`
-	Image     string                 `json:"image"`
-	ImageId   string                 `json:"imageId"`
-	Command   string                 `json:"command"`
-	State     string                 `json:"state"`
-	Status    string                 `json:"status"`
-	RestartCount int                 `json:"restartCount"`
-	Ports     map[string]interface{} `json:"ports"`
-	Labels    map[string]interface{} `json:"labels"`
-	Networks  map[string]interface{} `json:"networks,omitempty"`
-	Volumes   []string               `json:"volumes,omitempty"`
-	CreatedAt *string                `json:"createdAt,omitempty"`
-	StartedAt *string                `json:"startedAt,omitempty"`
+	DockerId     string                 `json:"dockerId"`
+	Name         string                 `json:"name"`
+	Image        string                 `json:"image"`
+	ImageId      string                 `json:"imageId"`
+	Command      string                 `json:"command"`
+	State        string                 `json:"state"`
+	Status       string                 `json:"status"`
+	RestartCount int                    `json:"restartCount"`
+	Ports        map[string]interface{} `json:"ports"`
+	Labels       map[string]interface{} `json:"labels"`
+	Networks     map[string]interface{} `json:"networks,omitempty"`
+	Volumes      []string               `json:"volumes,omitempty"`
+	CreatedAt    *string                `json:"createdAt,omitempty"`
+	StartedAt    *string                `json:"startedAt,omitempty"`
 }
 
 type HostSnapshot struct {
-	IPAddress        string `json:"ipAddress,omitempty"`
-	AgentVersion     string `json:"agentVersion,omitempty"`
-	CpuCount         int    `json:"cpuCount,omitempty"`
-	MemoryTotalBytes int64  `json:"memoryTotalBytes,omitempty"`
+	IPAddress        string   `json:"ipAddress,omitempty"`
+	IPAddresses      []string `json:"ipAddresses,omitempty"`
+	AgentVersion     string   `json:"agentVersion,omitempty"`
+	CpuCount         int      `json:"cpuCount,omitempty"`
+	MemoryTotalBytes int64    `json:"memoryTotalBytes,omitempty"`
+}
+
+// ProjectSnapshot is a Compose project derived from the
+// com.docker.compose.* labels of its containers.
+type ProjectSnapshot struct {
+	Name        string            `json:"name"`
+	WorkingDir  string            `json:"workingDir,omitempty"`
+	ConfigFiles []string          `json:"configFiles,omitempty"`
+	Services    []ServiceSnapshot `json:"services"`
+}
+
+type ServiceSnapshot struct {
+	Name      string              `json:"name"`
+	DependsOn []ServiceDependency `json:"dependsOn,omitempty"`
+	// Containers lists Docker IDs ordered by container number.
+	Containers []string `json:"containers"`
+	Running    int      `json:"running"`
+}
+
+// ServiceDependency is one com.docker.compose.depends_on entry. Condition is
+// service_started, service_healthy or service_completed_successfully.
+type ServiceDependency struct {
+	Service   string `json:"service"`
+	Condition string `json:"condition,omitempty"`
 }
 
 type InventorySnapshot struct {
 	Host       HostSnapshot        `json:"host,omitempty"`
 	Containers []ContainerSnapshot `json:"containers"`
+	Projects   []ProjectSnapshot   `json:"projects"`
+	// Mode and Revision are ignored by servers without delta support.
+	Mode     string `json:"mode,omitempty"`
+	Revision uint64 `json:"revision,omitempty"`
 }
 
-func (c *APIClient) SyncContainers(containers []ContainerSnapshot, host ...HostSnapshot) error {
-	if c.AgentToken == "" {
-		return fmt.Errorf("agent token is required for sync")
-	}
+// InventoryDelta carries only what changed since BaseRevision, the last
+// revision the server acknowledged.
+type InventoryDelta struct {
+	Mode         string              `json:"mode"`
+	Revision     uint64              `json:"revision"`
+	BaseRevision uint64              `json:"baseRevision"`
+	Host         *HostSnapshot       `json:"host,omitempty"`
+	Added        []ContainerSnapshot `json:"added"`
+	Changed      []ContainerSnapshot `json:"changed"`
+	Removed      []string            `json:"removed"`
+	// Projects is the complete project list, sent only when it changed.
+	Projects *[]ProjectSnapshot `json:"projects,omitempty"`
+}
 
-	url := fmt.Sprintf("%s/api/agent/containers", c.BaseURL)
+// SyncResponse is the server's answer to an inventory sync. Servers that
+// predate delta sync only send Status, which leaves the agent in full mode.
+type SyncResponse struct {
+	Status         string `json:"status"`
+	Revision       uint64 `json:"revision,omitempty"`
+	DeltaSupported bool   `json:"deltaSupported,omitempty"`
+	Resync         bool   `json:"resync,omitempty"`
+}
 
+func (c *APIClient) SyncContainers(ctx context.Context, containers []ContainerSnapshot, host ...HostSnapshot) error {
 	requestBody := any(containers)
 	if len(host) > 0 {
 		requestBody = InventorySnapshot{
@@ -143,27 +263,43 @@ func (c *APIClient) SyncContainers(containers []ContainerSnapshot, host ...HostS
 		}
 	}
 
-	bodyData, err := json.Marshal(requestBody)
-	if err != nil {
-		return fmt.Errorf("failed to marshal containers: %w", err)
+	_, err := c.postInventory(ctx, requestBody)
+	return err
+}
+
+func (c *APIClient) postInventory(ctx context.Context, requestBody any) (*SyncResponse, error) {
+	if c.AgentToken == "" {
+		return nil, fmt.Errorf("agent token is required for sync")
 	}
 
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(bodyData))
+	url := c.BaseURL + c.ContainersPath
+
+	bodyData, err := json.Marshal(requestBody)
 	if err != nil {
-		return fmt.Errorf("failed to create request: %w", err)
+		return nil, fmt.Errorf("failed to marshal containers: %w", err)
 	}
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", c.AgentToken))
 
-	resp, err := c.HTTPClient.Do(req)
+	resp, err := c.do(ctx, func(ctx context.Context) (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(bodyData))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", c.AgentToken))
+		return req, nil
+	})
 	if err != nil {
-		return fmt.Errorf("sync containers request failed: %w", err)
+		return nil, fmt.Errorf("sync containers request failed: %w", err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		return fmt.Errorf("sync containers request failed with status: %d", resp.StatusCode)
+		return nil, &StatusError{Op: "sync containers", StatusCode: resp.StatusCode}
 	}
 
-	return nil
+	var syncResp SyncResponse
+	if err := json.NewDecoder(resp.Body).Decode(&syncResp); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("failed to decode sync response: %w", err)
+	}
+	return &syncResp, nil
 }
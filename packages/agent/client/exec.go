@@ -0,0 +1,63 @@
+package client
+
+import (
+	"errors"
+	"time"
+)
+
+// ExecMessage is one frame of an interactive exec session. The same shape is
+// used in both directions and is told apart by Type:
+//
+//	cloud -> agent: exec.open, exec.stdin, exec.resize, exec.close
+//	agent -> cloud: exec.opened, exec.output, exec.exit
+//
+// Data is base64 in JSON. Stream is "stdout" or "stderr" on exec.output; a
+// TTY session only produces "stdout".
+type ExecMessage struct {
+	Type      string `json:"type"`
+	SessionId string `json:"session_id"`
+
+	// exec.open
+	ContainerId string   `json:"containerId,omitempty"`
+	Cmd         []string `json:"cmd,omitempty"`
+	Tty         bool     `json:"tty,omitempty"`
+	Env         []string `json:"env,omitempty"`
+	User        string   `json:"user,omitempty"`
+	WorkingDir  string   `json:"workingDir,omitempty"`
+
+	// exec.open and exec.resize
+	Cols uint `json:"cols,omitempty"`
+	Rows uint `json:"rows,omitempty"`
+
+	// exec.stdin and exec.output. EOF on exec.stdin closes the process's
+	// stdin.
+	Stream string `json:"stream,omitempty"`
+	Data   []byte `json:"data,omitempty"`
+	EOF    bool   `json:"eof,omitempty"`
+
+	// exec.exit. ExitCode is absent when the process was still running or
+	// never started; Reason says why the session ended.
+	ExitCode *int   `json:"exitCode,omitempty"`
+	Reason   string `json:"reason,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+var ErrNotConnected = errors.New("not connected to the cloud")
+
+// SendExec sends an exec frame only over the live connection. Unlike the
+// other Send methods it is never spooled, since a terminal session does not
+// survive a reconnect, and it blocks for up to writeWait when SendCh is full
+// so that output is slowed down rather than dropped.
+func (c *AgentWSClient) SendExec(msg ExecMessage) error {
+	if !c.IsConnected() {
+		return ErrNotConnected
+	}
+	timer := time.NewTimer(writeWait)
+	defer timer.Stop()
+	select {
+	case c.SendCh <- msg:
+		return nil
+	case <-timer.C:
+		return errors.New("timed out queueing exec message")
+	}
+}
@@ -0,0 +1,182 @@
+package client
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+)
+
+// InventorySyncer sends container inventory to the cloud, using delta sync
+// once the server has advertised support for it. Each sync carries a
+// revision; a delta only lists containers whose content hash differs from
+// the last acknowledged sync. Any doubt about the server's state (a revision
+// gap, a resync request, a rejected delta) falls back to a full snapshot.
+type InventorySyncer struct {
+	api *APIClient
+
+	revision       uint64
+	ackedRevision  uint64
+	acked          map[string]string // dockerId -> content hash
+	ackedHost      string
+	ackedProjects  string
+	deltaSupported bool
+	needFull       bool
+}
+
+func NewInventorySyncer(api *APIClient) *InventorySyncer {
+	return &InventorySyncer{
+		api: api,
+		// Seeding from the clock keeps revisions increasing across restarts.
+		revision: uint64(time.Now().UnixMilli()),
+		needFull: true,
+	}
+}
+
+// Sync reports containers, their Compose projects and host (if non-nil) to
+// the cloud.
+func (s *InventorySyncer) Sync(ctx context.Context, containers []ContainerSnapshot, projects []ProjectSnapshot, host *HostSnapshot) error {
+	if projects == nil {
+		projects = []ProjectSnapshot{}
+	}
+	state := syncState{
+		containers:   containers,
+		projects:     projects,
+		host:         host,
+		hashes:       make(map[string]string, len(containers)),
+		projectsHash: contentHash(projects),
+	}
+	for _, c := range containers {
+		state.hashes[c.DockerId] = contentHash(c)
+	}
+	if host != nil {
+		state.hostHash = contentHash(host)
+	}
+
+	if s.needFull || !s.deltaSupported {
+		return s.syncFull(ctx, state)
+	}
+
+	delta := InventoryDelta{
+		Mode:         "delta",
+		BaseRevision: s.ackedRevision,
+		Added:        []ContainerSnapshot{},
+		Changed:      []ContainerSnapshot{},
+		Removed:      []string{},
+	}
+	for _, c := range containers {
+		previous, known := s.acked[c.DockerId]
+		switch {
+		case !known:
+			delta.Added = append(delta.Added, c)
+		case previous != state.hashes[c.DockerId]:
+			delta.Changed = append(delta.Changed, c)
+		}
+	}
+	for id := range s.acked {
+		if _, ok := state.hashes[id]; !ok {
+			delta.Removed = append(delta.Removed, id)
+		}
+	}
+	if host != nil && state.hostHash != s.ackedHost {
+		delta.Host = host
+	}
+	if state.projectsHash != s.ackedProjects {
+		delta.Projects = &projects
+	}
+	if len(delta.Added) == 0 && len(delta.Changed) == 0 && len(delta.Removed) == 0 && delta.Host == nil && delta.Projects == nil {
+		return nil
+	}
+
+	s.revision++
+	delta.Revision = s.revision
+	resp, err := s.api.postInventory(ctx, delta)
+
+	var statusErr *StatusError
+	switch {
+	case errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusConflict:
+		log.Printf("Inventory revision gap at %d; sending full snapshot", delta.BaseRevision)
+		return s.syncFull(ctx, state)
+	case errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusBadRequest:
+		log.Printf("Server rejected inventory delta; falling back to full snapshots")
+		s.deltaSupported = false
+		return s.syncFull(ctx, state)
+	case err != nil:
+		// The server may or may not have applied it; the next delta's
+		// BaseRevision lets it detect which.
+		return err
+	case resp.Resync:
+		log.Printf("Server requested inventory resync")
+		return s.syncFull(ctx, state)
+	}
+
+	s.ack(resp, delta.Revision, state)
+	return nil
+}
+
+// syncState is one inventory reading together with the content hashes used
+// to diff it against the last acknowledged one.
+type syncState struct {
+	containers   []ContainerSnapshot
+	projects     []ProjectSnapshot
+	host         *HostSnapshot
+	hashes       map[string]string
+	hostHash     string
+	projectsHash string
+}
+
+func (s *InventorySyncer) syncFull(ctx context.Context, state syncState) error {
+	containers := state.containers
+	if containers == nil {
+		containers = []ContainerSnapshot{}
+	}
+
+	s.revision++
+	snapshot := InventorySnapshot{
+		Containers: containers,
+		Projects:   state.projects,
+		Mode:       "full",
+		Revision:   s.revision,
+	}
+	if state.host != nil {
+		snapshot.Host = *state.host
+	}
+
+	// Servers without delta support accept this shape and ignore the
+	// mode and revision; servers with it answer DeltaSupported.
+	s.needFull = true
+	resp, err := s.api.postInventory(ctx, snapshot)
+	if err != nil {
+		return err
+	}
+
+	s.needFull = false
+	s.ack(resp, snapshot.Revision, state)
+	return nil
+}
+
+func (s *InventorySyncer) ack(resp *SyncResponse, revision uint64, state syncState) {
+	s.ackedRevision = revision
+	s.acked = state.hashes
+	s.ackedHost = state.hostHash
+	s.ackedProjects = state.projectsHash
+	s.deltaSupported = resp.DeltaSupported
+	if resp.Resync {
+		s.needFull = true
+	}
+}
+
+// contentHash identifies a snapshot by its JSON form; encoding/json sorts
+// map keys, so equal snapshots always hash the same.
+func contentHash(v any) string {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
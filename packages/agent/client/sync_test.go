@@ -0,0 +1,275 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+)
+
+// syncRequest is the union of the full and delta inventory bodies.
+type syncRequest struct {
+	Mode         string              `json:"mode"`
+	Revision     uint64              `json:"revision"`
+	BaseRevision uint64              `json:"baseRevision"`
+	Containers   []ContainerSnapshot `json:"containers"`
+	Added        []ContainerSnapshot `json:"added"`
+	Changed      []ContainerSnapshot `json:"changed"`
+	Removed      []string            `json:"removed"`
+	Projects     *[]ProjectSnapshot  `json:"projects"`
+}
+
+// syncReply is the status code and body the fake server answers one
+// request with.
+type syncReply struct {
+	status int
+	body   SyncResponse
+}
+
+// fakeInventoryServer records every inventory request and answers them in
+// turn from replies, then with deltaSupported OK.
+type fakeInventoryServer struct {
+	t *testing.T
+
+	mu       sync.Mutex
+	replies  []syncReply
+	requests []syncRequest
+}
+
+func (f *fakeInventoryServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if got := r.Header.Get("Authorization"); got != "Bearer agent-token" {
+		f.t.Errorf("Authorization = %q", got)
+	}
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		f.t.Errorf("read body: %v", err)
+		return
+	}
+	var req syncRequest
+	if err := json.Unmarshal(data, &req); err != nil {
+		f.t.Errorf("decode body %s: %v", data, err)
+		return
+	}
+
+	f.mu.Lock()
+	f.requests = append(f.requests, req)
+
+	reply := syncReply{status: http.StatusOK, body: SyncResponse{Status: "ok", DeltaSupported: true}}
+	if len(f.replies) > 0 {
+		reply, f.replies = f.replies[0], f.replies[1:]
+	}
+	f.mu.Unlock()
+	reply.body.Revision = req.Revision
+	w.WriteHeader(reply.status)
+	json.NewEncoder(w).Encode(reply.body)
+}
+
+func newTestSyncer(t *testing.T, replies ...syncReply) (*InventorySyncer, *fakeInventoryServer) {
+	t.Helper()
+	fake := &fakeInventoryServer{t: t, replies: replies}
+	srv := httptest.NewServer(fake)
+	t.Cleanup(srv.Close)
+
+	api := NewAPIClient(srv.URL, "agent-token")
+	api.RetryAttempts = 0
+	return NewInventorySyncer(api), fake
+}
+
+func snapshot(id, state string) ContainerSnapshot {
+	return ContainerSnapshot{DockerId: id, Name: id, Image: "nginx:1.25", State: state}
+}
+
+func ids(containers []ContainerSnapshot) []string {
+	out := []string{}
+	for _, c := range containers {
+		out = append(out, c.DockerId)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// lastRequest returns the newest request and fails unless there were want
+// requests in total.
+func lastRequest(t *testing.T, fake *fakeInventoryServer, want int) syncRequest {
+	t.Helper()
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	if len(fake.requests) != want {
+		t.Fatalf("server saw %d requests, want %d", len(fake.requests), want)
+	}
+	return fake.requests[want-1]
+}
+
+func TestInventorySyncerDeltas(t *testing.T) {
+	ctx := context.Background()
+	syncer, fake := newTestSyncer(t)
+
+	if err := syncer.Sync(ctx, []ContainerSnapshot{snapshot("a", "running"), snapshot("b", "running"), snapshot("c", "running")}, nil, nil); err != nil {
+		t.Fatalf("Sync: %v", err)
+	}
+	full := lastRequest(t, fake, 1)
+	if full.Mode != "full" || !reflect.DeepEqual(ids(full.Containers), []string{"a", "b", "c"}) {
+		t.Fatalf("first sync = %+v, want a full snapshot of a, b and c", full)
+	}
+
+	// b stopped, c is gone and d is new.
+	if err := syncer.Sync(ctx, []ContainerSnapshot{snapshot("a", "running"), snapshot("b", "exited"), snapshot("d", "running")}, nil, nil); err != nil {
+		t.Fatalf("Sync: %v", err)
+	}
+	delta := lastRequest(t, fake, 2)
+	if delta.Mode != "delta" || delta.BaseRevision != full.Revision || delta.Revision <= full.Revision {
+		t.Errorf("delta mode/base/revision = %s/%d/%d, want delta/%d/>%d", delta.Mode, delta.BaseRevision, delta.Revision, full.Revision, full.Revision)
+	}
+	if got := ids(delta.Added); !reflect.DeepEqual(got, []string{"d"}) {
+		t.Errorf("added = %v, want [d]", got)
+	}
+	if got := ids(delta.Changed); !reflect.DeepEqual(got, []string{"b"}) {
+		t.Errorf("changed = %v, want [b]", got)
+	}
+	if !reflect.DeepEqual(delta.Removed, []string{"c"}) {
+		t.Errorf("removed = %v, want [c]", delta.Removed)
+	}
+	if delta.Projects != nil {
+		t.Errorf("unchanged projects were sent: %v", *delta.Projects)
+	}
+
+	// Nothing changed: nothing is sent.
+	if err := syncer.Sync(ctx, []ContainerSnapshot{snapshot("a", "running"), snapshot("b", "exited"), snapshot("d", "running")}, nil, nil); err != nil {
+		t.Fatalf("Sync: %v", err)
+	}
+	lastRequest(t, fake, 2)
+
+	// Only the project list changed.
+	projects := []ProjectSnapshot{{Name: "shop", Services: []ServiceSnapshot{{Name: "web", Containers: []string{"a"}}}}}
+	if err := syncer.Sync(ctx, []ContainerSnapshot{snapshot("a", "running"), snapshot("b", "exited"), snapshot("d", "running")}, projects, nil); err != nil {
+		t.Fatalf("Sync: %v", err)
+	}
+	if delta := lastRequest(t, fake, 3); delta.Projects == nil || !reflect.DeepEqual(*delta.Projects, projects) {
+		t.Errorf("projects = %v, want %v", delta.Projects, projects)
+	}
+}
+
+func TestInventorySyncerFallsBackToFull(t *testing.T) {
+	ok := syncReply{status: http.StatusOK, body: SyncResponse{Status: "ok", DeltaSupported: true}}
+	tests := []struct {
+		name string
+		// reply answers the delta; fallback answers the full snapshot that
+		// replaces it.
+		reply, fallback syncReply
+		// wantNextFull is whether the sync after the fallback is full too.
+		wantNextFull bool
+	}{
+		{
+			name:     "revision gap",
+			reply:    syncReply{status: http.StatusConflict},
+			fallback: ok,
+		},
+		{
+			name:  "delta rejected",
+			reply: syncReply{status: http.StatusBadRequest},
+			// A server that rejects deltas does not advertise them.
+			fallback:     syncReply{status: http.StatusOK, body: SyncResponse{Status: "ok"}},
+			wantNextFull: true,
+		},
+		{
+			name:     "resync requested",
+			reply:    syncReply{status: http.StatusOK, body: SyncResponse{Status: "ok", DeltaSupported: true, Resync: true}},
+			fallback: ok,
+		},
+		{
+			name:         "resync requested again",
+			reply:        syncReply{status: http.StatusOK, body: SyncResponse{Status: "ok", DeltaSupported: true, Resync: true}},
+			fallback:     syncReply{status: http.StatusOK, body: SyncResponse{Status: "ok", DeltaSupported: true, Resync: true}},
+			wantNextFull: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			syncer, fake := newTestSyncer(t, ok, tt.reply, tt.fallback)
+
+			if err := syncer.Sync(ctx, []ContainerSnapshot{snapshot("a", "running")}, nil, nil); err != nil {
+				t.Fatalf("Sync: %v", err)
+			}
+			if err := syncer.Sync(ctx, []ContainerSnapshot{snapshot("a", "exited")}, nil, nil); err != nil {
+				t.Fatalf("Sync: %v", err)
+			}
+			// The delta is followed at once by a full snapshot.
+			full := lastRequest(t, fake, 3)
+			delta := fake.requests[1]
+			if delta.Mode != "delta" || full.Mode != "full" || !reflect.DeepEqual(ids(full.Containers), []string{"a"}) {
+				t.Fatalf("requests = %+v then %+v, want a delta then a full snapshot", delta, full)
+			}
+			if full.Revision <= delta.Revision {
+				t.Errorf("full snapshot revision %d does not follow the delta's %d", full.Revision, delta.Revision)
+			}
+
+			if err := syncer.Sync(ctx, []ContainerSnapshot{snapshot("a", "running")}, nil, nil); err != nil {
+				t.Fatalf("Sync: %v", err)
+			}
+			next := lastRequest(t, fake, 4)
+			wantMode := "delta"
+			if tt.wantNextFull {
+				wantMode = "full"
+			}
+			if next.Mode != wantMode {
+				t.Errorf("next sync mode = %s, want %s", next.Mode, wantMode)
+			}
+		})
+	}
+}
+
+func TestInventorySyncerFailedDelta(t *testing.T) {
+	ctx := context.Background()
+	syncer, fake := newTestSyncer(t,
+		syncReply{status: http.StatusOK, body: SyncResponse{Status: "ok", DeltaSupported: true}},
+		syncReply{status: http.StatusBadGateway},
+	)
+
+	if err := syncer.Sync(ctx, []ContainerSnapshot{snapshot("a", "running")}, nil, nil); err != nil {
+		t.Fatalf("Sync: %v", err)
+	}
+	full := lastRequest(t, fake, 1)
+
+	if err := syncer.Sync(ctx, []ContainerSnapshot{snapshot("a", "exited")}, nil, nil); err == nil {
+		t.Fatalf("Sync succeeded against a failing server")
+	}
+	failed := lastRequest(t, fake, 2)
+
+	// The server may have applied the failed delta, so the retry uses a new
+	// revision but the same base, letting the server spot the gap.
+	if err := syncer.Sync(ctx, []ContainerSnapshot{snapshot("a", "exited")}, nil, nil); err != nil {
+		t.Fatalf("Sync: %v", err)
+	}
+	retry := lastRequest(t, fake, 3)
+	if retry.Mode != "delta" || retry.BaseRevision != full.Revision || retry.Revision <= failed.Revision {
+		t.Errorf("retry mode/base/revision = %s/%d/%d, want delta/%d/>%d", retry.Mode, retry.BaseRevision, retry.Revision, full.Revision, failed.Revision)
+	}
+	if got := ids(retry.Changed); !reflect.DeepEqual(got, []string{"a"}) {
+		t.Errorf("retry changed = %v, want [a]", got)
+	}
+}
+
+func TestInventorySyncerTransportError(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	srv.Close()
+	api := NewAPIClient(srv.URL, "agent-token")
+	api.RetryAttempts = 0
+
+	syncer := NewInventorySyncer(api)
+	before := syncer.revision
+	if err := syncer.Sync(context.Background(), []ContainerSnapshot{snapshot("a", "running")}, nil, nil); err == nil {
+		t.Fatalf("Sync succeeded without a server")
+	}
+	// Nothing was acknowledged, so the next attempt is still a full
+	// snapshot, under a fresh revision.
+	if !syncer.needFull || syncer.ackedRevision != 0 || syncer.revision <= before {
+		t.Errorf("after a transport error needFull=%v acked=%d revision=%d (was %d)", syncer.needFull, syncer.ackedRevision, syncer.revision, before)
+	}
+}
@@ -1,103 +1,478 @@
 package client
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"math/rand"
 	"net/url"
 	"strings"
+	"sync"
 	"time"
 
+	"docker-dashboard-agent/spool"
 	"github.com/gorilla/websocket"
 )
 
+// ConnState is the lifecycle state of the supervised WebSocket connection.
+type ConnState int
+
+const (
+	StateDisconnected ConnState = iota
+	StateConnecting
+	StateConnected
+	StateBackingOff
+)
+
+func (s ConnState) String() string {
+	switch s {
+	case StateConnecting:
+		return "connecting"
+	case StateConnected:
+		return "connected"
+	case StateBackingOff:
+		return "backing-off"
+	default:
+		return "disconnected"
+	}
+}
+
+const (
+	writeWait  = 10 * time.Second
+	pongWait   = 60 * time.Second
+	pingPeriod = 30 * time.Second
+
+	// stableAfter is how long a connection must stay up before the
+	// reconnect backoff starts again from MinBackoff. A cloud that accepts
+	// the handshake and then drops the connection keeps the backoff growing.
+	stableAfter = 30 * time.Second
+)
+
 type AgentWSClient struct {
 	BaseURL       string
+	Path          string
 	Token         string
-	Conn          *websocket.Conn
 	SendCh        chan interface{}
-	ActionHandler func(actionId, containerId, action string)
+	ActionHandler func(req ActionRequest)
+
+	// CancelHandler, if set, receives action_cancel messages naming the
+	// action to abort in ActionId.
+	CancelHandler func(req ActionRequest)
+
+	// ExecHandler, if set, receives exec.* frames in the order they arrived.
+	// It is called from the read loop and must not block.
+	ExecHandler func(msg ExecMessage)
+
+	// MinBackoff and MaxBackoff bound the delay between reconnect attempts.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	// OnStateChange, if set, is called after every connection state
+	// transition. It must not block.
+	OnStateChange func(ConnState)
+
+	// Spool, if set, holds outbound messages while the cloud is unreachable
+	// or SendCh is full. They are replayed in order after reconnecting and
+	// carry "replayed": true so the cloud can tell them from live data.
+	Spool *spool.Spool
+
+	mu      sync.Mutex
+	state   ConnState
+	spooled chan struct{}
 }
 
-func NewAgentWSClient(baseURL, token string, handler func(actionId, containerId, action string)) *AgentWSClient {
+func NewAgentWSClient(baseURL, token string, handler func(req ActionRequest)) *AgentWSClient {
 	wsURL := strings.Replace(baseURL, "http://", "ws://", 1)
 	wsURL = strings.Replace(wsURL, "https://", "wss://", 1)
-	
+
 	return &AgentWSClient{
 		BaseURL:       wsURL,
+		Path:          "/ws/agent",
 		Token:         token,
 		SendCh:        make(chan interface{}, 100),
 		ActionHandler: handler,
+		MinBackoff:    time.Second,
+		MaxBackoff:    time.Minute,
+		spooled:       make(chan struct{}, 1),
+	}
+}
+
+// State returns the current connection state.
+func (c *AgentWSClient) State() ConnState {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.state
+}
+
+func (c *AgentWSClient) IsConnected() bool {
+	return c.State() == StateConnected
+}
+
+func (c *AgentWSClient) setState(state ConnState) {
+	c.mu.Lock()
+	changed := c.state != state
+	c.state = state
+	c.mu.Unlock()
+
+	if changed && c.OnStateChange != nil {
+		c.OnStateChange(state)
+	}
+}
+
+// Run keeps the agent connected until ctx is cancelled. Each time the
+// connection drops it redials with exponential backoff and jitter; every
+// connection drains the same SendCh, so queued messages survive a reconnect.
+func (c *AgentWSClient) Run(ctx context.Context) {
+	defer c.setState(StateDisconnected)
+
+	attempt := 0
+	for {
+		c.setState(StateConnecting)
+		conn, err := c.dial(ctx)
+		if err != nil {
+			log.Printf("Failed to connect to WebSocket: %v", err)
+		} else {
+			c.setState(StateConnected)
+			connectedAt := time.Now()
+			c.serve(ctx, conn)
+			if time.Since(connectedAt) >= stableAfter {
+				attempt = 0
+			}
+		}
+
+		if ctx.Err() != nil {
+			return
+		}
+
+		delay := c.backoff(attempt)
+		attempt++
+		c.setState(StateBackingOff)
+		log.Printf("Reconnecting to WebSocket in %s", delay.Round(time.Millisecond))
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
 	}
 }
 
-func (c *AgentWSClient) Connect() error {
-	u, err := url.Parse(fmt.Sprintf("%s/ws/agent", c.BaseURL))
+func (c *AgentWSClient) dial(ctx context.Context) (*websocket.Conn, error) {
+	u, err := url.Parse(c.BaseURL + c.Path)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	
+
 	q := u.Query()
 	q.Set("token", c.Token)
 	u.RawQuery = q.Encode()
 
-	log.Printf("Connecting to WebSocket: %s", u.String())
-	conn, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+	log.Printf("Connecting to WebSocket: %s%s", c.BaseURL, c.Path)
+	conn, _, err := websocket.DefaultDialer.DialContext(ctx, u.String(), nil)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	return conn, nil
+}
+
+// backoff returns the delay before reconnect attempt n: an exponentially
+// growing ceiling capped at MaxBackoff, with the upper half jittered so a
+// fleet of agents does not reconnect in lockstep after a cloud restart.
+func (c *AgentWSClient) backoff(attempt int) time.Duration {
+	ceiling := c.MaxBackoff
+	if attempt < 30 {
+		if d := c.MinBackoff << uint(attempt); d > 0 && d < ceiling {
+			ceiling = d
+		}
 	}
+	half := ceiling / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
 
-	c.Conn = conn
+// serve pumps messages over conn until either direction fails or ctx is
+// cancelled, then closes the connection.
+func (c *AgentWSClient) serve(ctx context.Context, conn *websocket.Conn) {
+	readDone := make(chan struct{})
+	go func() {
+		defer close(readDone)
+		c.readLoop(conn)
+	}()
 
-	// Start write loop
-	go c.writeLoop()
+	c.writeLoop(ctx, conn, readDone)
+	conn.Close()
+	<-readDone
+}
 
-	// Start read loop (for actions, ping/pong, to be expanded in Plan 06)
-	go c.readLoop()
+func (c *AgentWSClient) writeLoop(ctx context.Context, conn *websocket.Conn, readDone <-chan struct{}) {
+	ping := time.NewTicker(pingPeriod)
+	defer ping.Stop()
 
-	return nil
+	for {
+		// Anything already in SendCh was queued before whatever is in the
+		// spool, so it goes first; the spool is drained once SendCh is empty.
+		select {
+		case msg := <-c.SendCh:
+			if err := c.write(conn, msg); err != nil {
+				log.Printf("WebSocket write error: %v", err)
+				return
+			}
+			continue
+		default:
+		}
+		if c.Spool != nil && c.Spool.Size() > 0 {
+			if err := c.replaySpool(conn, readDone); err != nil {
+				log.Printf("WebSocket spool replay stopped: %v", err)
+				return
+			}
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			conn.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),
+				time.Now().Add(writeWait))
+			return
+		case <-readDone:
+			return
+		case <-ping.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeWait)); err != nil {
+				log.Printf("WebSocket ping error: %v", err)
+				return
+			}
+		case <-c.spooled:
+		case msg := <-c.SendCh:
+			if err := c.write(conn, msg); err != nil {
+				log.Printf("WebSocket write error: %v", err)
+				return
+			}
+		}
+	}
 }
 
-func (c *AgentWSClient) writeLoop() {
-	defer c.Conn.Close()
-	for msg := range c.SendCh {
-		c.Conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
-		err := c.Conn.WriteJSON(msg)
-		if err != nil {
-			log.Printf("WebSocket write error: %v", err)
-			return // Exits and closes connection, standard retry logic would reconnect
+func (c *AgentWSClient) write(conn *websocket.Conn, msg interface{}) error {
+	conn.SetWriteDeadline(time.Now().Add(writeWait))
+	return conn.WriteJSON(msg)
+}
+
+// replaySpool sends spooled messages, tagging each one as replayed along
+// with the time it was spooled.
+func (c *AgentWSClient) replaySpool(conn *websocket.Conn, readDone <-chan struct{}) error {
+	return c.Spool.Replay(func(payload []byte, spooledAt time.Time) error {
+		select {
+		case <-readDone:
+			return errors.New("connection closed")
+		default:
+		}
+
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(payload, &fields); err != nil {
+			log.Printf("Dropping malformed spooled message: %v", err)
+			return nil
 		}
+		fields["replayed"] = json.RawMessage("true")
+		fields["spooledAt"], _ = json.Marshal(spooledAt)
+
+		return c.write(conn, fields)
+	})
+}
+
+// send queues msg for the cloud without ever blocking the caller. While
+// disconnected, or once anything is spooled, messages go to the spool so
+// they stay in order; without a spool they are dropped when SendCh is full.
+func (c *AgentWSClient) send(msg interface{}) {
+	if c.Spool != nil && (!c.IsConnected() || c.Spool.Size() > 0) {
+		c.spool(msg)
+		return
+	}
+
+	select {
+	case c.SendCh <- msg:
+	default:
+		if c.Spool != nil {
+			c.spool(msg)
+			return
+		}
+		log.Printf("Outbound queue full; dropping %T message", msg)
 	}
 }
 
-func (c *AgentWSClient) readLoop() {
-	defer c.Conn.Close()
-	c.Conn.SetReadDeadline(time.Now().Add(60 * time.Second))
-	c.Conn.SetPongHandler(func(string) error {
-		c.Conn.SetReadDeadline(time.Now().Add(60 * time.Second))
+func (c *AgentWSClient) spool(msg interface{}) {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		log.Printf("Failed to encode %T message for spool: %v", msg, err)
+		return
+	}
+	if err := c.Spool.Append(data); err != nil {
+		log.Printf("Failed to spool %T message: %v", msg, err)
+		return
+	}
+
+	select {
+	case c.spooled <- struct{}{}:
+	default:
+	}
+}
+
+func (c *AgentWSClient) readLoop(conn *websocket.Conn) {
+	conn.SetReadDeadline(time.Now().Add(pongWait))
+	conn.SetPongHandler(func(string) error {
+		conn.SetReadDeadline(time.Now().Add(pongWait))
 		return nil
 	})
+	// The cloud pings every 30s; treat its pings as liveness too.
+	conn.SetPingHandler(func(appData string) error {
+		conn.SetReadDeadline(time.Now().Add(pongWait))
+		err := conn.WriteControl(websocket.PongMessage, []byte(appData), time.Now().Add(writeWait))
+		if err == websocket.ErrCloseSent {
+			return nil
+		}
+		return err
+	})
 	for {
-		var raw map[string]interface{}
-		err := c.Conn.ReadJSON(&raw)
+		_, data, err := conn.ReadMessage()
 		if err != nil {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
 				log.Printf("WebSocket read error: %v", err)
 			}
 			break
 		}
-		if raw["type"] == "action" && c.ActionHandler != nil {
-			actionId, _ := raw["action_id"].(string)
-			containerId, _ := raw["containerId"].(string)
-			action, _ := raw["action"].(string)
-			go c.ActionHandler(actionId, containerId, action)
+		c.dispatch(data)
+	}
+}
+
+// dispatch routes one inbound message by its "type". Unknown types are
+// ignored so the cloud can add messages before every agent understands them.
+func (c *AgentWSClient) dispatch(data []byte) {
+	var envelope struct {
+		Type string `json:"type"`
+	}
+	if err := json.Unmarshal(data, &envelope); err != nil {
+		log.Printf("Ignoring malformed WebSocket message: %v", err)
+		return
+	}
+
+	switch envelope.Type {
+	case "action":
+		if c.ActionHandler == nil {
+			return
+		}
+		var req ActionRequest
+		if err := json.Unmarshal(data, &req); err != nil {
+			log.Printf("Ignoring malformed action message: %v", err)
+			return
+		}
+		go c.ActionHandler(req)
+	case "action_cancel":
+		if c.CancelHandler == nil {
+			return
+		}
+		var req ActionRequest
+		if err := json.Unmarshal(data, &req); err != nil {
+			log.Printf("Ignoring malformed action_cancel message: %v", err)
+			return
 		}
+		c.CancelHandler(req)
+	case "exec.open", "exec.stdin", "exec.resize", "exec.close":
+		if c.ExecHandler == nil {
+			return
+		}
+		var msg ExecMessage
+		if err := json.Unmarshal(data, &msg); err != nil {
+			log.Printf("Ignoring malformed exec message: %v", err)
+			return
+		}
+		c.ExecHandler(msg)
 	}
 }
 
+// ActionVersion is the newest action envelope version this agent
+// understands. Messages without a version are treated as version 1.
+const ActionVersion = 1
+
+// ActionRequest is a container action sent by the cloud. Params carries
+// action-specific options and is decoded with DecodeParams into the type the
+// action expects. IdempotencyKey identifies a logical request across
+// redeliveries; when empty, ActionId is used instead. Container actions name
+// ContainerId; PROJECT_* actions name a Compose Project instead.
+type ActionRequest struct {
+	Version        int             `json:"version,omitempty"`
+	ActionId       string          `json:"action_id"`
+	IdempotencyKey string          `json:"idempotency_key,omitempty"`
+	Action         string          `json:"action"`
+	ContainerId    string          `json:"containerId,omitempty"`
+	Project        string          `json:"project,omitempty"`
+	Params         json.RawMessage `json:"params,omitempty"`
+	ExpiresAt      *time.Time      `json:"expires_at,omitempty"`
+
+	// Set on signed envelopes; see the signing package for what is signed.
+	Timestamp string `json:"timestamp,omitempty"`
+	Nonce     string `json:"nonce,omitempty"`
+	Signature string `json:"signature,omitempty"`
+}
+
+// DecodeParams unmarshals Params into v. Missing params leave v unchanged.
+func (r ActionRequest) DecodeParams(v interface{}) error {
+	if len(r.Params) == 0 || string(r.Params) == "null" {
+		return nil
+	}
+	if err := json.Unmarshal(r.Params, v); err != nil {
+		return fmt.Errorf("invalid params for %s: %w", r.Action, err)
+	}
+	return nil
+}
+
+// ActionResult reports the outcome of an ActionRequest. State is the
+// container's state afterwards ("removed" once it is gone) when it could be
+// determined. Rule names the policy rule behind a DENIED status. Duplicate
+// is set when the result was replayed from an earlier
+// execution of the same request rather than produced by running it again.
+type ActionResult struct {
+	ActionId    string                 `json:"action_id"`
+	Action      string                 `json:"action,omitempty"`
+	ContainerId string                 `json:"containerId,omitempty"`
+	Project     string                 `json:"project,omitempty"`
+	Status      string                 `json:"status"`
+	Error       string                 `json:"error"`
+	State       string                 `json:"state,omitempty"`
+	Rule        string                 `json:"rule,omitempty"`
+	Details     map[string]interface{} `json:"details,omitempty"`
+	DurationMs  int64                  `json:"durationMs"`
+	Duplicate   bool                   `json:"duplicate,omitempty"`
+	// Origin is "schedule" for actions the agent ran on its own; empty
+	// for actions requested by the cloud.
+	Origin string `json:"origin,omitempty"`
+}
+
+// ActionProgress is an intermediate update for a running action, sent
+// until its ActionResult. Current and Total are byte counts while an image
+// is being pulled.
+type ActionProgress struct {
+	ActionId string `json:"action_id"`
+	Stage    string `json:"stage"`
+	Message  string `json:"message,omitempty"`
+	Current  int64  `json:"current,omitempty"`
+	Total    int64  `json:"total,omitempty"`
+}
+
+type actionProgressPayload struct {
+	Type string `json:"type"`
+	ActionProgress
+}
+
+type actionResultPayload struct {
+	Type string `json:"type"`
+	ActionResult
+}
+
 type MetricPayload struct {
-	Type     string      `json:"type"`
-	HostId   string      `json:"hostId"`
-	Metrics  []MetricItem `json:"metrics"`
+	Type    string       `json:"type"`
+	HostId  string       `json:"hostId"`
+	Metrics []MetricItem `json:"metrics"`
 }
 
 type MetricItem struct {
@@ -106,6 +481,78 @@ type MetricItem struct {
 	MemoryUsageBytes int64   `json:"memoryUsageBytes"`
 	NetworkRxBytes   int64   `json:"networkRxBytes"`
 	NetworkTxBytes   int64   `json:"networkTxBytes"`
+
+	// Optional fields are nil when the daemon or cgroup version does not
+	// report them, and are omitted so older clouds are unaffected. Byte, op
+	// and throttling values are cumulative counters, like the network ones.
+	BlockReadBytes      *int64   `json:"blockReadBytes,omitempty"`
+	BlockWriteBytes     *int64   `json:"blockWriteBytes,omitempty"`
+	BlockReadOps        *int64   `json:"blockReadOps,omitempty"`
+	BlockWriteOps       *int64   `json:"blockWriteOps,omitempty"`
+	PidsCurrent         *int64   `json:"pidsCurrent,omitempty"`
+	MemoryLimitBytes    *int64   `json:"memoryLimitBytes,omitempty"`
+	MemoryPercent       *float64 `json:"memoryPercent,omitempty"`
+	CpuThrottledPeriods *int64   `json:"cpuThrottledPeriods,omitempty"`
+	CpuThrottledTimeNs  *int64   `json:"cpuThrottledTimeNs,omitempty"`
+}
+
+type HostMetricPayload struct {
+	Type    string      `json:"type"`
+	HostId  string      `json:"hostId"`
+	Metrics HostMetrics `json:"metrics"`
+}
+
+// HostMetrics describes the machine the agent runs on. Every figure is
+// optional because each comes from a different procfs source; byte and
+// traffic counters are cumulative since boot.
+type HostMetrics struct {
+	Timestamp string `json:"timestamp"`
+
+	Load1           *float64 `json:"load1,omitempty"`
+	Load5           *float64 `json:"load5,omitempty"`
+	Load15          *float64 `json:"load15,omitempty"`
+	CpuUsagePercent *float64 `json:"cpuUsagePercent,omitempty"`
+
+	MemoryTotalBytes     *int64 `json:"memoryTotalBytes,omitempty"`
+	MemoryAvailableBytes *int64 `json:"memoryAvailableBytes,omitempty"`
+	MemoryUsedBytes      *int64 `json:"memoryUsedBytes,omitempty"`
+	SwapTotalBytes       *int64 `json:"swapTotalBytes,omitempty"`
+	SwapFreeBytes        *int64 `json:"swapFreeBytes,omitempty"`
+
+	DiskReadBytes  *int64 `json:"diskReadBytes,omitempty"`
+	DiskWriteBytes *int64 `json:"diskWriteBytes,omitempty"`
+	NetworkRxBytes *int64 `json:"networkRxBytes,omitempty"`
+	NetworkTxBytes *int64 `json:"networkTxBytes,omitempty"`
+
+	// Usage of the filesystem holding the Docker root directory.
+	FilesystemPath       string `json:"filesystemPath,omitempty"`
+	FilesystemTotalBytes *int64 `json:"filesystemTotalBytes,omitempty"`
+	FilesystemFreeBytes  *int64 `json:"filesystemFreeBytes,omitempty"`
+	FilesystemUsedBytes  *int64 `json:"filesystemUsedBytes,omitempty"`
+}
+
+// SupervisorEvent records something the self-healing supervisor did or
+// decided about a managed container, for the cloud's audit trail. Event is
+// one of restart_scheduled, restarted, restart_failed, restart_skipped or
+// circuit_open.
+type SupervisorEvent struct {
+	Timestamp     string `json:"timestamp"`
+	ContainerId   string `json:"containerId"`
+	ContainerName string `json:"containerName,omitempty"`
+	Event         string `json:"event"`
+	// Reason is what triggered the intervention: "exited" or "unhealthy".
+	Reason      string `json:"reason"`
+	ExitCode    *int   `json:"exitCode,omitempty"`
+	Attempt     int    `json:"attempt"`
+	MaxAttempts int    `json:"maxAttempts"`
+	DelayMs     int64  `json:"delayMs,omitempty"`
+	Error       string `json:"error,omitempty"`
+}
+
+type supervisorEventPayload struct {
+	Type   string `json:"type"`
+	HostId string `json:"hostId"`
+	SupervisorEvent
 }
 
 type LogPayload struct {
@@ -118,29 +565,62 @@ type LogItem struct {
 	ContainerId string `json:"containerId"`
 	Stream      string `json:"stream"` // "stdout" or "stderr"
 	Message     string `json:"message"`
+	// Timestamp is when Docker captured the line, in RFC3339Nano.
+	Timestamp string `json:"timestamp"`
+	// Seq increases by one per line of a container, so the cloud can order
+	// lines with equal timestamps and drop ones it has already received.
+	Seq uint64 `json:"seq"`
+
+	// Set when structured parsing is enabled. Level is one of trace, debug,
+	// info, warn, error or fatal; LoggedAt is the time found in the line
+	// itself; Fields holds the rest of a JSON or logfmt line.
+	Level    string                 `json:"level,omitempty"`
+	LoggedAt string                 `json:"loggedAt,omitempty"`
+	Fields   map[string]interface{} `json:"fields,omitempty"`
 }
 
 func (c *AgentWSClient) SendMetrics(hostId string, metrics []MetricItem) {
-	c.SendCh <- MetricPayload{
+	c.send(MetricPayload{
 		Type:    "metrics",
 		HostId:  hostId,
 		Metrics: metrics,
-	}
+	})
+}
+
+func (c *AgentWSClient) SendHostMetrics(hostId string, metrics HostMetrics) {
+	c.send(HostMetricPayload{
+		Type:    "host_metrics",
+		HostId:  hostId,
+		Metrics: metrics,
+	})
 }
 
 func (c *AgentWSClient) SendLogs(hostId string, logs []LogItem) {
-	c.SendCh <- LogPayload{
+	c.send(LogPayload{
 		Type:   "logs",
 		HostId: hostId,
 		Logs:   logs,
-	}
+	})
 }
 
-func (c *AgentWSClient) SendActionResult(actionId, status, errorMsg string) {
-	c.SendCh <- map[string]string{
-		"type":      "action_result",
-		"action_id": actionId,
-		"status":    status,
-		"error":     errorMsg,
-	}
+func (c *AgentWSClient) SendActionResult(result ActionResult) {
+	c.send(actionResultPayload{
+		Type:         "action_result",
+		ActionResult: result,
+	})
+}
+
+func (c *AgentWSClient) SendActionProgress(progress ActionProgress) {
+	c.send(actionProgressPayload{
+		Type:           "action_progress",
+		ActionProgress: progress,
+	})
+}
+
+func (c *AgentWSClient) SendSupervisorEvent(hostId string, event SupervisorEvent) {
+	c.send(supervisorEventPayload{
+		Type:            "supervisor_event",
+		HostId:          hostId,
+		SupervisorEvent: event,
+	})
 }
@@ -0,0 +1,195 @@
+package compose
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	apiclient "docker-dashboard-agent/client"
+)
+
+// Labels Docker Compose puts on every container it creates.
+const (
+	LabelProject         = "com.docker.compose.project"
+	LabelService         = "com.docker.compose.service"
+	LabelContainerNumber = "com.docker.compose.container-number"
+	LabelDependsOn       = "com.docker.compose.depends_on"
+	LabelWorkingDir      = "com.docker.compose.project.working_dir"
+	LabelConfigFiles     = "com.docker.compose.project.config_files"
+	LabelOneoff          = "com.docker.compose.oneoff"
+)
+
+// Projects groups containers into Compose projects and services. One-off
+// containers from `docker compose run` are not part of a service and are
+// left out. Projects and services are sorted by name.
+func Projects(containers []apiclient.ContainerSnapshot) []apiclient.ProjectSnapshot {
+	type member struct {
+		id     string
+		number int
+	}
+	type service struct {
+		snapshot apiclient.ServiceSnapshot
+		members  []member
+	}
+	type project struct {
+		snapshot apiclient.ProjectSnapshot
+		services map[string]*service
+	}
+
+	projects := make(map[string]*project)
+	for _, c := range containers {
+		projectName := label(c, LabelProject)
+		serviceName := label(c, LabelService)
+		if projectName == "" || serviceName == "" || strings.EqualFold(label(c, LabelOneoff), "true") {
+			continue
+		}
+
+		p, ok := projects[projectName]
+		if !ok {
+			p = &project{
+				snapshot: apiclient.ProjectSnapshot{Name: projectName},
+				services: make(map[string]*service),
+			}
+			projects[projectName] = p
+		}
+		if p.snapshot.WorkingDir == "" {
+			p.snapshot.WorkingDir = label(c, LabelWorkingDir)
+		}
+		if p.snapshot.ConfigFiles == nil {
+			if files := label(c, LabelConfigFiles); files != "" {
+				p.snapshot.ConfigFiles = strings.Split(files, ",")
+			}
+		}
+
+		s, ok := p.services[serviceName]
+		if !ok {
+			s = &service{snapshot: apiclient.ServiceSnapshot{
+				Name:      serviceName,
+				DependsOn: ParseDependsOn(label(c, LabelDependsOn)),
+			}}
+			p.services[serviceName] = s
+		}
+		number, _ := strconv.Atoi(label(c, LabelContainerNumber))
+		s.members = append(s.members, member{id: c.DockerId, number: number})
+		if c.State == "running" {
+			s.snapshot.Running++
+		}
+	}
+
+	result := make([]apiclient.ProjectSnapshot, 0, len(projects))
+	for _, p := range projects {
+		for _, s := range p.services {
+			sort.Slice(s.members, func(i, j int) bool {
+				if s.members[i].number != s.members[j].number {
+					return s.members[i].number < s.members[j].number
+				}
+				return s.members[i].id < s.members[j].id
+			})
+			s.snapshot.Containers = make([]string, len(s.members))
+			for i, m := range s.members {
+				s.snapshot.Containers[i] = m.id
+			}
+			p.snapshot.Services = append(p.snapshot.Services, s.snapshot)
+		}
+		sort.Slice(p.snapshot.Services, func(i, j int) bool {
+			return p.snapshot.Services[i].Name < p.snapshot.Services[j].Name
+		})
+		result = append(result, p.snapshot)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+	return result
+}
+
+// ParseDependsOn reads the depends_on label, a comma-separated list of
+// "service:condition:restart" entries. Older Compose versions write bare
+// service names, which are treated as service_started.
+func ParseDependsOn(value string) []apiclient.ServiceDependency {
+	var deps []apiclient.ServiceDependency
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.Split(entry, ":")
+		dep := apiclient.ServiceDependency{Service: parts[0], Condition: "service_started"}
+		if len(parts) > 1 && parts[1] != "" {
+			dep.Condition = parts[1]
+		}
+		deps = append(deps, dep)
+	}
+	return deps
+}
+
+// StartOrder sorts the project's services so that every service comes after
+// the services it depends on. Dependencies on services that have no
+// containers on this host are ignored. Ties are broken by name so the order
+// is stable.
+func StartOrder(project apiclient.ProjectSnapshot) ([]apiclient.ServiceSnapshot, error) {
+	byName := make(map[string]apiclient.ServiceSnapshot, len(project.Services))
+	for _, s := range project.Services {
+		byName[s.Name] = s
+	}
+
+	const (
+		unvisited = iota
+		visiting
+		done
+	)
+	marks := make(map[string]int, len(byName))
+	order := make([]apiclient.ServiceSnapshot, 0, len(byName))
+
+	var visit func(name string, path []string) error
+	visit = func(name string, path []string) error {
+		switch marks[name] {
+		case done:
+			return nil
+		case visiting:
+			return fmt.Errorf("dependency cycle in project %s: %s", project.Name, strings.Join(append(path, name), " -> "))
+		}
+		marks[name] = visiting
+		s := byName[name]
+		deps := make([]string, 0, len(s.DependsOn))
+		for _, d := range s.DependsOn {
+			if _, ok := byName[d.Service]; ok {
+				deps = append(deps, d.Service)
+			}
+		}
+		sort.Strings(deps)
+		for _, d := range deps {
+			if err := visit(d, append(path, name)); err != nil {
+				return err
+			}
+		}
+		marks[name] = done
+		order = append(order, s)
+		return nil
+	}
+
+	names := make([]string, 0, len(byName))
+	for name := range byName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := visit(name, nil); err != nil {
+			return nil, err
+		}
+	}
+	return order, nil
+}
+
+// Find returns the named project from projects.
+func Find(projects []apiclient.ProjectSnapshot, name string) (apiclient.ProjectSnapshot, bool) {
+	for _, p := range projects {
+		if p.Name == name {
+			return p, true
+		}
+	}
+	return apiclient.ProjectSnapshot{}, false
+}
+
+func label(c apiclient.ContainerSnapshot, key string) string {
+	v, _ := c.Labels[key].(string)
+	return v
+}
@@ -0,0 +1,99 @@
+package compose
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	apiclient "docker-dashboard-agent/client"
+)
+
+func TestParseDependsOn(t *testing.T) {
+	tests := []struct {
+		value string
+		want  []apiclient.ServiceDependency
+	}{
+		{"", nil},
+		{"db:service_healthy:false", []apiclient.ServiceDependency{{Service: "db", Condition: "service_healthy"}}},
+		{
+			"db:service_healthy:true,migrate:service_completed_successfully:false",
+			[]apiclient.ServiceDependency{
+				{Service: "db", Condition: "service_healthy"},
+				{Service: "migrate", Condition: "service_completed_successfully"},
+			},
+		},
+		// Older Compose versions write bare service names.
+		{"db, cache", []apiclient.ServiceDependency{
+			{Service: "db", Condition: "service_started"},
+			{Service: "cache", Condition: "service_started"},
+		}},
+		{"db::true,,", []apiclient.ServiceDependency{{Service: "db", Condition: "service_started"}}},
+	}
+	for _, tt := range tests {
+		if got := ParseDependsOn(tt.value); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseDependsOn(%q) = %+v, want %+v", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestStartOrder(t *testing.T) {
+	// service builds a service from its name and depends_on label.
+	service := func(name, dependsOn string) apiclient.ServiceSnapshot {
+		return apiclient.ServiceSnapshot{Name: name, DependsOn: ParseDependsOn(dependsOn)}
+	}
+
+	tests := []struct {
+		name     string
+		services []apiclient.ServiceSnapshot
+		want     []string
+		wantErr  string
+	}{
+		{
+			name:     "chain",
+			services: []apiclient.ServiceSnapshot{service("web", "api:service_started:false"), service("api", "db:service_healthy:false"), service("db", "")},
+			want:     []string{"db", "api", "web"},
+		},
+		{
+			name:     "ties are broken by name",
+			services: []apiclient.ServiceSnapshot{service("worker", "db"), service("web", "db"), service("cache", ""), service("db", "")},
+			want:     []string{"cache", "db", "web", "worker"},
+		},
+		{
+			name:     "dependency with no containers on this host",
+			services: []apiclient.ServiceSnapshot{service("web", "api,db"), service("api", "")},
+			want:     []string{"api", "web"},
+		},
+		{
+			name:     "cycle",
+			services: []apiclient.ServiceSnapshot{service("web", "api"), service("api", "web"), service("db", "")},
+			wantErr:  "api -> web -> api",
+		},
+		{
+			name:     "service depending on itself",
+			services: []apiclient.ServiceSnapshot{service("web", "web")},
+			wantErr:  "web -> web",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			order, err := StartOrder(apiclient.ProjectSnapshot{Name: "shop", Services: tt.services})
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("StartOrder error = %v, want one containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("StartOrder: %v", err)
+			}
+			var got []string
+			for _, s := range order {
+				got = append(got, s.Name)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("StartOrder = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,441 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+type Config struct {
+	Mode              string           `yaml:"mode"`
+	LogLevel          string           `yaml:"log_level"`
+	HeartbeatInterval time.Duration    `yaml:"heartbeat_interval"`
+	EnrollToken       string           `yaml:"enroll_token"`
+	Docker            DockerConfig     `yaml:"docker"`
+	API               APIConfig        `yaml:"api"`
+	Agent             AgentConfig      `yaml:"agent"`
+	Containers        ContainersConfig `yaml:"containers"`
+	Logs              LogsConfig       `yaml:"logs"`
+	Spool             SpoolConfig      `yaml:"spool"`
+	Host              HostConfig       `yaml:"host"`
+	Actions           ActionsConfig    `yaml:"actions"`
+	Exec              ExecConfig       `yaml:"exec"`
+	Schedule          ScheduleConfig   `yaml:"schedule"`
+}
+
+type DockerConfig struct {
+	Host       string        `yaml:"host"`
+	Timeout    time.Duration `yaml:"timeout"`
+	APIVersion string        `yaml:"api_version"`
+}
+
+type APIConfig struct {
+	URL            string        `yaml:"url"`
+	EnrollPath     string        `yaml:"enroll_path"`
+	HeartbeatPath  string        `yaml:"heartbeat_path"`
+	ContainersPath string        `yaml:"containers_path"`
+	WebSocketPath  string        `yaml:"websocket_path"`
+	Timeout        time.Duration `yaml:"timeout"`
+	RetryAttempts  int           `yaml:"retry_attempts"`
+	RetryDelay     time.Duration `yaml:"retry_delay"`
+
+	// Bounds for the WebSocket reconnect backoff.
+	ReconnectMinDelay time.Duration `yaml:"reconnect_min_delay"`
+	ReconnectMaxDelay time.Duration `yaml:"reconnect_max_delay"`
+}
+
+type AgentConfig struct {
+	Name   string `yaml:"name"`
+	IDFile string `yaml:"id_file"`
+}
+
+type ContainersConfig struct {
+	ManagedLabel string        `yaml:"managed_label"`
+	PollInterval time.Duration `yaml:"poll_interval"`
+	SyncInterval time.Duration `yaml:"sync_interval"`
+	StatsMaxAge  time.Duration `yaml:"stats_max_age"`
+	StopTimeout  time.Duration `yaml:"stop_timeout"`
+	AutoRestart  bool          `yaml:"auto_restart"`
+
+	// With AutoRestart, managed containers that exit unexpectedly or turn
+	// unhealthy are restarted after a delay that doubles from
+	// RestartBackoffMin up to RestartBackoffMax. After RestartMaxAttempts
+	// restarts that did not stay up for RestartResetAfter the agent gives up.
+	RestartBackoffMin  time.Duration `yaml:"restart_backoff_min"`
+	RestartBackoffMax  time.Duration `yaml:"restart_backoff_max"`
+	RestartMaxAttempts int           `yaml:"restart_max_attempts"`
+	RestartResetAfter  time.Duration `yaml:"restart_reset_after"`
+
+	// ReconcileInterval is how often the full list+inspect pass runs to
+	// catch anything the Docker events stream missed.
+	ReconcileInterval time.Duration `yaml:"reconcile_interval"`
+}
+
+type LogsConfig struct {
+	// Tail is how many existing lines are sent for a container the agent
+	// has no cursor for yet.
+	Tail          string        `yaml:"tail"`
+	BatchSize     int           `yaml:"batch_size"`
+	FlushInterval time.Duration `yaml:"flush_interval"`
+	// MaxLineBytes caps a single log line; the rest is replaced by a
+	// truncation marker.
+	MaxLineBytes int `yaml:"max_line_bytes"`
+
+	// CursorFile stores how far each container's logs were shipped, so
+	// streams resume without gaps or repeats. Empty keeps cursors in memory.
+	CursorFile string `yaml:"cursor_file"`
+
+	// Multiline applies to every container; docker-dashboard.multiline.*
+	// labels override it per container.
+	Multiline MultilineConfig `yaml:"multiline"`
+
+	// Parse extracts level, message, time and fields from JSON and logfmt
+	// lines, and the level from plain text. The docker-dashboard.logs.parse
+	// label overrides it per container.
+	Parse bool `yaml:"parse"`
+}
+
+// MultilineConfig joins lines such as stack traces into one log entry. A
+// line matching Continue, or not matching Start, belongs to the entry before
+// it. Without either pattern lines are not joined.
+type MultilineConfig struct {
+	Start    string        `yaml:"start"`
+	Continue string        `yaml:"continue"`
+	MaxLines int           `yaml:"max_lines"`
+	MaxBytes int           `yaml:"max_bytes"`
+	Timeout  time.Duration `yaml:"timeout"`
+}
+
+// SpoolConfig controls the on-disk buffer for outbound messages while the
+// cloud is unreachable. An empty Dir disables spooling.
+type SpoolConfig struct {
+	Dir           string `yaml:"dir"`
+	MaxSizeMB     int64  `yaml:"max_size_mb"`
+	SegmentSizeMB int64  `yaml:"segment_size_mb"`
+}
+
+// ExecConfig controls interactive exec sessions opened from the dashboard.
+// Sessions are not signed, so while actions.public_keys is set they are
+// refused unless AllowUnsigned is also set.
+type ExecConfig struct {
+	Enabled       bool          `yaml:"enabled"`
+	MaxSessions   int           `yaml:"max_sessions"`
+	IdleTimeout   time.Duration `yaml:"idle_timeout"`
+	AllowUnsigned bool          `yaml:"allow_unsigned"`
+}
+
+// ScheduleConfig controls actions scheduled with
+// docker-dashboard.schedule.<action> labels. Timezone is an IANA name; empty
+// uses the agent's local time.
+type ScheduleConfig struct {
+	Enabled  bool   `yaml:"enabled"`
+	Timezone string `yaml:"timezone"`
+}
+
+// HostConfig locates the host filesystem when the agent runs in a
+// container, e.g. proc_path "/host/proc" and root_path "/host" with the
+// host's / mounted read-only at /host.
+type HostConfig struct {
+	ProcPath string `yaml:"proc_path"`
+	RootPath string `yaml:"root_path"`
+}
+
+type ActionsConfig struct {
+	// DedupeTTL is how long a finished action's result is kept so that a
+	// redelivered copy gets the same result instead of running again.
+	DedupeTTL time.Duration `yaml:"dedupe_ttl"`
+
+	// PolicyFile optionally restricts which remote actions run; see
+	// policy.example.yaml. Containers labelled
+	// docker-dashboard.protected=true are always refused.
+	PolicyFile string `yaml:"policy_file"`
+
+	// PublicKeys are base64 Ed25519 keys. When any are set, only actions
+	// signed by one of them are executed.
+	PublicKeys []string `yaml:"public_keys"`
+	// SignatureWindow is how far a signed action's timestamp may be from
+	// the agent's clock.
+	SignatureWindow time.Duration `yaml:"signature_window"`
+}
+
+// Default returns the configuration used when no file, environment variable
+// or flag overrides a setting. The values match what the agent hardcoded
+// before it had a config file.
+func Default() *Config {
+	return &Config{
+		Mode:              "production",
+		LogLevel:          "info",
+		HeartbeatInterval: 30 * time.Second,
+		Docker: DockerConfig{
+			Timeout: 30 * time.Second,
+		},
+		API: APIConfig{
+			URL:            "http://localhost:3001",
+			EnrollPath:     "/api/agent/enroll",
+			HeartbeatPath:  "/api/agent/heartbeat",
+			ContainersPath: "/api/agent/containers",
+			WebSocketPath:  "/ws/agent",
+			Timeout:        10 * time.Second,
+			RetryAttempts:  3,
+			RetryDelay:     5 * time.Second,
+
+			ReconnectMinDelay: time.Second,
+			ReconnectMaxDelay: time.Minute,
+		},
+		Agent: AgentConfig{
+			IDFile: "./agent.id",
+		},
+		Containers: ContainersConfig{
+			ManagedLabel: "docker-dashboard.managed",
+			PollInterval: 5 * time.Second,
+			SyncInterval: 10 * time.Second,
+			StatsMaxAge:  15 * time.Second,
+			StopTimeout:  10 * time.Second,
+
+			RestartBackoffMin:  5 * time.Second,
+			RestartBackoffMax:  5 * time.Minute,
+			RestartMaxAttempts: 5,
+			RestartResetAfter:  10 * time.Minute,
+
+			ReconcileInterval: 5 * time.Minute,
+		},
+		Logs: LogsConfig{
+			Tail:          "50",
+			BatchSize:     50,
+			FlushInterval: time.Second,
+			MaxLineBytes:  64 * 1024,
+			CursorFile:    "./log-cursors.json",
+			Multiline: MultilineConfig{
+				MaxLines: 500,
+				MaxBytes: 64 * 1024,
+				Timeout:  time.Second,
+			},
+		},
+		Spool: SpoolConfig{
+			Dir:           "./spool",
+			MaxSizeMB:     64,
+			SegmentSizeMB: 4,
+		},
+		Host: HostConfig{
+			ProcPath: "/proc",
+		},
+		Actions: ActionsConfig{
+			DedupeTTL:       10 * time.Minute,
+			SignatureWindow: 5 * time.Minute,
+		},
+		Exec: ExecConfig{
+			Enabled:     false,
+			MaxSessions: 4,
+			IdleTimeout: 15 * time.Minute,
+		},
+		Schedule: ScheduleConfig{
+			Enabled: true,
+		},
+	}
+}
+
+// LoadFile overlays the YAML file at path onto cfg. Keys missing from the
+// file keep their current values.
+func LoadFile(cfg *Config, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	if err := yaml.Unmarshal(data, cfg); err != nil {
+		return fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+
+	return nil
+}
+
+// ApplyEnv overlays AGENT_* environment variables onto cfg.
+func ApplyEnv(cfg *Config, getenv func(string) string) error {
+	setString := func(key string, dst *string) {
+		if v := getenv(key); v != "" {
+			*dst = v
+		}
+	}
+	setDuration := func(key string, dst *time.Duration) error {
+		v := getenv(key)
+		if v == "" {
+			return nil
+		}
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("invalid %s: %w", key, err)
+		}
+		*dst = d
+		return nil
+	}
+
+	setString("AGENT_API_URL", &cfg.API.URL)
+	setString("AGENT_TOKEN", &cfg.EnrollToken)
+	setString("AGENT_NAME", &cfg.Agent.Name)
+	setString("AGENT_ID_FILE", &cfg.Agent.IDFile)
+	setString("AGENT_SPOOL_DIR", &cfg.Spool.Dir)
+	setString("AGENT_LOG_CURSOR_FILE", &cfg.Logs.CursorFile)
+	setString("AGENT_MODE", &cfg.Mode)
+	setString("AGENT_LOG_LEVEL", &cfg.LogLevel)
+	setString("AGENT_POLICY_FILE", &cfg.Actions.PolicyFile)
+	if v := getenv("AGENT_ACTION_PUBLIC_KEYS"); v != "" {
+		cfg.Actions.PublicKeys = strings.Split(v, ",")
+	}
+	setString("AGENT_HOST_PROC", &cfg.Host.ProcPath)
+	setString("AGENT_HOST_ROOT", &cfg.Host.RootPath)
+	setString("DOCKER_HOST", &cfg.Docker.Host)
+	setString("DOCKER_API_VERSION", &cfg.Docker.APIVersion)
+
+	if err := setDuration("AGENT_HEARTBEAT_INTERVAL", &cfg.HeartbeatInterval); err != nil {
+		return err
+	}
+	if err := setDuration("AGENT_SYNC_INTERVAL", &cfg.Containers.SyncInterval); err != nil {
+		return err
+	}
+	if err := setDuration("AGENT_POLL_INTERVAL", &cfg.Containers.PollInterval); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Validate checks that every setting is usable and normalizes values that
+// have a canonical form (trailing slashes, log level case).
+func (c *Config) Validate() error {
+	var problems []string
+	positive := func(name string, d time.Duration) {
+		if d <= 0 {
+			problems = append(problems, fmt.Sprintf("%s must be greater than zero", name))
+		}
+	}
+
+	c.API.URL = strings.TrimSuffix(c.API.URL, "/")
+	if !strings.HasPrefix(c.API.URL, "http://") && !strings.HasPrefix(c.API.URL, "https://") {
+		problems = append(problems, "api.url must start with http:// or https://")
+	}
+	for _, p := range []struct{ name, path string }{
+		{"api.enroll_path", c.API.EnrollPath},
+		{"api.heartbeat_path", c.API.HeartbeatPath},
+		{"api.containers_path", c.API.ContainersPath},
+		{"api.websocket_path", c.API.WebSocketPath},
+	} {
+		if !strings.HasPrefix(p.path, "/") {
+			problems = append(problems, fmt.Sprintf("%s must start with /", p.name))
+		}
+	}
+	positive("api.timeout", c.API.Timeout)
+	if c.API.RetryAttempts < 0 {
+		problems = append(problems, "api.retry_attempts must not be negative")
+	}
+	if c.API.RetryDelay < 0 {
+		problems = append(problems, "api.retry_delay must not be negative")
+	}
+	positive("api.reconnect_min_delay", c.API.ReconnectMinDelay)
+	if c.API.ReconnectMaxDelay < c.API.ReconnectMinDelay {
+		problems = append(problems, "api.reconnect_max_delay must not be less than api.reconnect_min_delay")
+	}
+
+	positive("docker.timeout", c.Docker.Timeout)
+	positive("heartbeat_interval", c.HeartbeatInterval)
+	positive("containers.poll_interval", c.Containers.PollInterval)
+	positive("containers.sync_interval", c.Containers.SyncInterval)
+	positive("containers.reconcile_interval", c.Containers.ReconcileInterval)
+	positive("containers.stats_max_age", c.Containers.StatsMaxAge)
+	if c.Containers.StopTimeout < 0 {
+		problems = append(problems, "containers.stop_timeout must not be negative")
+	}
+	if c.Containers.AutoRestart {
+		positive("containers.restart_backoff_min", c.Containers.RestartBackoffMin)
+		if c.Containers.RestartBackoffMax < c.Containers.RestartBackoffMin {
+			problems = append(problems, "containers.restart_backoff_max must not be less than containers.restart_backoff_min")
+		}
+		if c.Containers.RestartMaxAttempts <= 0 {
+			problems = append(problems, "containers.restart_max_attempts must be greater than zero")
+		}
+		positive("containers.restart_reset_after", c.Containers.RestartResetAfter)
+	}
+
+	if c.Logs.BatchSize <= 0 {
+		problems = append(problems, "logs.batch_size must be greater than zero")
+	}
+	positive("logs.flush_interval", c.Logs.FlushInterval)
+	if c.Logs.MaxLineBytes < 1024 {
+		problems = append(problems, "logs.max_line_bytes must be at least 1024")
+	}
+	if c.Logs.Multiline.MaxLines <= 0 {
+		problems = append(problems, "logs.multiline.max_lines must be greater than zero")
+	}
+	if c.Logs.Multiline.MaxBytes <= 0 {
+		problems = append(problems, "logs.multiline.max_bytes must be greater than zero")
+	}
+	positive("logs.multiline.timeout", c.Logs.Multiline.Timeout)
+	for key, pattern := range map[string]string{
+		"logs.multiline.start":    c.Logs.Multiline.Start,
+		"logs.multiline.continue": c.Logs.Multiline.Continue,
+	} {
+		if _, err := regexp.Compile(pattern); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", key, err))
+		}
+	}
+	if c.Logs.Tail != "all" {
+		if n, err := strconv.Atoi(c.Logs.Tail); err != nil || n < 0 {
+			problems = append(problems, `logs.tail must be a number or "all"`)
+		}
+	}
+
+	if c.Spool.Dir != "" {
+		if c.Spool.SegmentSizeMB <= 0 {
+			problems = append(problems, "spool.segment_size_mb must be greater than zero")
+		}
+		if c.Spool.MaxSizeMB < c.Spool.SegmentSizeMB {
+			problems = append(problems, "spool.max_size_mb must not be less than spool.segment_size_mb")
+		}
+	}
+
+	positive("actions.dedupe_ttl", c.Actions.DedupeTTL)
+	if len(c.Actions.PublicKeys) > 0 {
+		positive("actions.signature_window", c.Actions.SignatureWindow)
+	}
+
+	if c.Exec.Enabled {
+		if c.Exec.MaxSessions <= 0 {
+			problems = append(problems, "exec.max_sessions must be greater than zero")
+		}
+		positive("exec.idle_timeout", c.Exec.IdleTimeout)
+	}
+
+	if c.Schedule.Timezone != "" {
+		if _, err := time.LoadLocation(c.Schedule.Timezone); err != nil {
+			problems = append(problems, fmt.Sprintf("schedule.timezone: %v", err))
+		}
+	}
+
+	if c.Host.ProcPath == "" {
+		problems = append(problems, "host.proc_path must not be empty")
+	}
+
+	c.LogLevel = strings.ToLower(c.LogLevel)
+	// Only debug changes anything: it adds file and line numbers and logs
+	// every WebSocket state change.
+	switch c.LogLevel {
+	case "debug", "info":
+	default:
+		problems = append(problems, "log_level must be debug or info")
+	}
+
+	switch c.Mode {
+	case "development", "production":
+	default:
+		problems = append(problems, "mode must be development or production")
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid configuration: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
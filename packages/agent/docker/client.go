@@ -2,251 +2,435 @@ package docker
 
 import (
 	"context"
-	"encoding/binary"
-	"encoding/json"
 	"fmt"
-	"io"
+	"net"
 	"strings"
 	"time"
 
 	apiclient "docker-dashboard-agent/client"
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/filters"
 	"github.com/docker/docker/client"
 )
 
 type Client struct {
 	dockerCli *client.Client
+	opts      Options
 }
 
-func NewClient() (*Client, error) {
-	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+type Options struct {
+	// Host overrides DOCKER_HOST when set.
+	Host string
+	// APIVersion pins the Engine API version; empty negotiates with the daemon.
+	APIVersion string
+	// Timeout bounds non-streaming Engine API calls.
+	Timeout time.Duration
+	// StopTimeout is the grace period before a stopped container is killed.
+	StopTimeout time.Duration
+	// LogTail is the number of existing lines sent when a log stream starts
+	// without a cursor.
+	LogTail string
+	// LogMaxLine is the longest log line, in bytes, sent as is; longer ones
+	// are truncated. Zero uses DefaultLogMaxLine.
+	LogMaxLine int
+}
+
+func NewClient(opts Options) (*Client, error) {
+	clientOpts := []client.Opt{client.FromEnv}
+	if opts.Host != "" {
+		clientOpts = append(clientOpts, client.WithHost(opts.Host))
+	}
+	if opts.APIVersion != "" {
+		clientOpts = append(clientOpts, client.WithVersion(opts.APIVersion))
+	} else {
+		clientOpts = append(clientOpts, client.WithAPIVersionNegotiation())
+	}
+
+	cli, err := client.NewClientWithOpts(clientOpts...)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create docker client: %w", err)
 	}
 
 	return &Client{
 		dockerCli: cli,
+		opts:      opts,
 	}, nil
 }
 
+// withTimeout applies the configured API timeout to a non-streaming call.
+// Streaming calls (logs, stats) must not use it.
+func (c *Client) withTimeout(ctx context.Context, extra time.Duration) (context.Context, context.CancelFunc) {
+	if c.opts.Timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, c.opts.Timeout+extra)
+}
+
 func (c *Client) GetInfo(ctx context.Context) (types.Info, error) {
+	ctx, cancel := c.withTimeout(ctx, 0)
+	defer cancel()
 	return c.dockerCli.Info(ctx)
 }
 
+// ListContainers lists every container and inspects each one. It costs one
+// API call per container, so callers that only need changes should use
+// InspectContainer instead.
 func (c *Client) ListContainers(ctx context.Context) ([]apiclient.ContainerSnapshot, error) {
-	containers, err := c.dockerCli.ContainerList(ctx, container.ListOptions{All: true})
+	listCtx, cancel := c.withTimeout(ctx, 0)
+	containers, err := c.dockerCli.ContainerList(listCtx, container.ListOptions{All: true})
+	cancel()
 	if err != nil {
 		return nil, fmt.Errorf("failed to list containers: %w", err)
 	}
 
 	var snapshots []apiclient.ContainerSnapshot
 	for _, cnt := range containers {
-		// Normalize name (remove leading slash)
-		name := ""
-		if len(cnt.Names) > 0 {
-			name = strings.TrimPrefix(cnt.Names[0], "/")
-		}
-
-		// Normalize ports
-		ports := make(map[string]interface{})
-		for _, p := range cnt.Ports {
-			key := fmt.Sprintf("%d/%s", p.PrivatePort, p.Type)
-			if p.PublicPort != 0 {
-				ports[key] = p.PublicPort
-			} else {
-				ports[key] = nil
-			}
-		}
-
-		// Normalize labels
-		labels := make(map[string]interface{})
-		for k, v := range cnt.Labels {
-			labels[k] = v
+		inspectCtx, cancel := c.withTimeout(ctx, 0)
+		inspect, err := c.dockerCli.ContainerInspect(inspectCtx, cnt.ID)
+		cancel()
+		if client.IsErrNotFound(err) {
+			// Removed between the list and the inspect.
+			continue
 		}
-
-		inspect, err := c.dockerCli.ContainerInspect(ctx, cnt.ID)
 		if err != nil {
 			return nil, fmt.Errorf("failed to inspect container %s: %w", cnt.ID, err)
 		}
 
-		var startedAt *string
-		if inspect.State != nil && inspect.State.StartedAt != "" && inspect.State.StartedAt != "0001-01-01T00:00:00Z" {
-			startedAt = stringPtr(inspect.State.StartedAt)
-		}
+		snapshots = append(snapshots, buildSnapshot(cnt, inspect))
+	}
+
+	return snapshots, nil
+}
+
+// InspectContainer builds the snapshot of a single container. It returns
+// nil without an error when the container no longer exists.
+func (c *Client) InspectContainer(ctx context.Context, containerID string) (*apiclient.ContainerSnapshot, error) {
+	ctx, cancel := c.withTimeout(ctx, 0)
+	defer cancel()
+
+	// The list endpoint is the only source of the human-readable Status.
+	containers, err := c.dockerCli.ContainerList(ctx, container.ListOptions{
+		All:     true,
+		Filters: filters.NewArgs(filters.Arg("id", containerID)),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list container %s: %w", containerID, err)
+	}
 
-		var createdAt *string
-		if inspect.Created != "" {
-			createdAt = stringPtr(inspect.Created)
+	var cnt *types.Container
+	for i := range containers {
+		if containers[i].ID == containerID || strings.HasPrefix(containers[i].ID, containerID) {
+			cnt = &containers[i]
+			break
 		}
+	}
+	if cnt == nil {
+		return nil, nil
+	}
 
-		networks := make(map[string]interface{})
-		if inspect.NetworkSettings != nil {
-			for networkName, network := range inspect.NetworkSettings.Networks {
-				networks[networkName] = map[string]interface{}{
-					"networkId": network.NetworkID,
-					"ipAddress": network.IPAddress,
-					"gateway":   network.Gateway,
-					"macAddress": network.MacAddress,
-				}
-			}
+	inspect, err := c.dockerCli.ContainerInspect(ctx, cnt.ID)
+	if client.IsErrNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to inspect container %s: %w", containerID, err)
+	}
+
+	snapshot := buildSnapshot(*cnt, inspect)
+	return &snapshot, nil
+}
+
+// ContainerStatuses returns the human-readable Status, e.g. "Up 5 minutes",
+// of every container by ID. It takes a single list call, so it is cheap
+// enough to run on every inventory sync.
+func (c *Client) ContainerStatuses(ctx context.Context) (map[string]string, error) {
+	ctx, cancel := c.withTimeout(ctx, 0)
+	defer cancel()
+
+	containers, err := c.dockerCli.ContainerList(ctx, container.ListOptions{All: true})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list containers: %w", err)
+	}
+	statuses := make(map[string]string, len(containers))
+	for _, cnt := range containers {
+		statuses[cnt.ID] = cnt.Status
+	}
+	return statuses, nil
+}
+
+// inventoryEvents are the container events that can change a snapshot.
+var inventoryEvents = []string{"create", "start", "die", "destroy", "rename", "update", "pause", "unpause"}
+
+// ContainerEvents streams container events until ctx is cancelled or the
+// daemon connection fails, in which case an error is sent. actions limits
+// the stream to those event actions; none means the inventory events.
+func (c *Client) ContainerEvents(ctx context.Context, actions ...string) (<-chan events.Message, <-chan error) {
+	if len(actions) == 0 {
+		actions = inventoryEvents
+	}
+	args := filters.NewArgs(filters.Arg("type", string(events.ContainerEventType)))
+	for _, action := range actions {
+		args.Add("event", action)
+	}
+	return c.dockerCli.Events(ctx, types.EventsOptions{Filters: args})
+}
+
+func buildSnapshot(cnt types.Container, inspect types.ContainerJSON) apiclient.ContainerSnapshot {
+	// Normalize name (remove leading slash)
+	name := ""
+	if len(cnt.Names) > 0 {
+		name = strings.TrimPrefix(cnt.Names[0], "/")
+	}
+
+	// Normalize ports
+	ports := make(map[string]interface{})
+	for _, p := range cnt.Ports {
+		key := fmt.Sprintf("%d/%s", p.PrivatePort, p.Type)
+		if p.PublicPort != 0 {
+			ports[key] = p.PublicPort
+		} else {
+			ports[key] = nil
 		}
+	}
 
-		volumes := make([]string, 0, len(inspect.Mounts))
-		for _, mount := range inspect.Mounts {
-			if mount.Destination != "" {
-				volumes = append(volumes, mount.Destination)
-				continue
-			}
-			if mount.Name != "" {
-				volumes = append(volumes, mount.Name)
+	// Normalize labels
+	labels := make(map[string]interface{})
+	for k, v := range cnt.Labels {
+		labels[k] = v
+	}
+
+	var startedAt *string
+	if inspect.State != nil && inspect.State.StartedAt != "" && inspect.State.StartedAt != "0001-01-01T00:00:00Z" {
+		startedAt = stringPtr(inspect.State.StartedAt)
+	}
+
+	var createdAt *string
+	if inspect.ContainerJSONBase != nil && inspect.Created != "" {
+		createdAt = stringPtr(inspect.Created)
+	}
+
+	networks := make(map[string]interface{})
+	if inspect.NetworkSettings != nil {
+		for networkName, network := range inspect.NetworkSettings.Networks {
+			networks[networkName] = map[string]interface{}{
+				"networkId":  network.NetworkID,
+				"ipAddress":  network.IPAddress,
+				"gateway":    network.Gateway,
+				"macAddress": network.MacAddress,
 			}
 		}
+	}
 
-		restartCount := 0
-		if inspect.State != nil {
-			restartCount = inspect.State.RestartCount
+	volumes := make([]string, 0, len(inspect.Mounts))
+	for _, mount := range inspect.Mounts {
+		if mount.Destination != "" {
+			volumes = append(volumes, mount.Destination)
+			continue
 		}
-
-		snapshot := apiclient.ContainerSnapshot{
-			DockerId:  cnt.ID,
-			Name:      name,
-			Image:     cnt.Image,
-			ImageId:   cnt.ImageID,
-			Command:   cnt.Command,
-			State:     cnt.State,
-			Status:    cnt.Status,
-			RestartCount: restartCount,
-			Ports:     ports,
-			Labels:    labels,
-			Networks:  networks,
-			Volumes:   volumes,
-			CreatedAt: createdAt,
-			StartedAt: startedAt,
+		if mount.Name != "" {
+			volumes = append(volumes, mount.Name)
 		}
+	}
 
-		snapshots = append(snapshots, snapshot)
+	restartCount := 0
+	if inspect.ContainerJSONBase != nil {
+		restartCount = inspect.RestartCount
 	}
 
-	return snapshots, nil
+	return apiclient.ContainerSnapshot{
+		DockerId:     cnt.ID,
+		Name:         name,
+		Image:        cnt.Image,
+		ImageId:      cnt.ImageID,
+		Command:      cnt.Command,
+		State:        cnt.State,
+		Status:       cnt.Status,
+		RestartCount: restartCount,
+		Ports:        ports,
+		Labels:       labels,
+		Networks:     networks,
+		Volumes:      volumes,
+		CreatedAt:    createdAt,
+		StartedAt:    startedAt,
+	}
 }
 
 func (c *Client) GetHostSnapshot(ctx context.Context) (*apiclient.HostSnapshot, error) {
+	ctx, cancel := c.withTimeout(ctx, 0)
+	defer cancel()
+
 	info, err := c.dockerCli.Info(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get docker info for host snapshot: %w", err)
 	}
 
-	ipAddress := ""
-	if info.Swarm.NodeAddr != "" {
-		ipAddress = info.Swarm.NodeAddr
+	ipAddresses := hostIPAddresses()
+	ipAddress := info.Swarm.NodeAddr
+	if ipAddress == "" && len(ipAddresses) > 0 {
+		ipAddress = ipAddresses[0]
 	}
 
 	return &apiclient.HostSnapshot{
 		IPAddress:        ipAddress,
+		IPAddresses:      ipAddresses,
 		CpuCount:         info.NCPU,
 		MemoryTotalBytes: int64(info.MemTotal),
 	}, nil
 }
 
-func stringPtr(value string) *string {
-	return &value
-}
-
-func (c *Client) GetContainerStats(ctx context.Context, containerID string) (*apiclient.MetricItem, error) {
-	stats, err := c.dockerCli.ContainerStats(ctx, containerID, false)
+// hostIPAddresses lists the addresses of the machine's own interfaces,
+// leaving out loopback and the bridges and veths Docker creates. With host
+// networking these are the host's addresses; otherwise they belong to the
+// agent's container.
+func hostIPAddresses() []string {
+	ifaces, err := net.Interfaces()
 	if err != nil {
-		return nil, fmt.Errorf("failed to get stats: %w", err)
-	}
-	defer stats.Body.Close()
-
-	var v types.StatsJSON
-	if err := json.NewDecoder(stats.Body).Decode(&v); err != nil {
-		return nil, fmt.Errorf("failed to decode stats: %w", err)
+		return nil
 	}
 
-	// Calculate CPU usage percent
-	cpuDelta := float64(v.CPUStats.CPUUsage.TotalUsage) - float64(v.PreCPUStats.CPUUsage.TotalUsage)
-	systemDelta := float64(v.CPUStats.SystemUsage) - float64(v.PreCPUStats.SystemUsage)
-	cpuUsage := 0.0
-	if systemDelta > 0.0 && cpuDelta > 0.0 {
-		cpuUsage = (cpuDelta / systemDelta) * float64(len(v.CPUStats.CPUUsage.PercpuUsage)) * 100.0
+	var addresses []string
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		if iface.Name == "docker0" || strings.HasPrefix(iface.Name, "br-") || strings.HasPrefix(iface.Name, "veth") {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if !ok || ipNet.IP.IsLinkLocalUnicast() {
+				continue
+			}
+			addresses = append(addresses, ipNet.IP.String())
+		}
 	}
+	return addresses
+}
 
-	// Calculate memory usage
-	memUsage := v.MemoryStats.Usage - v.MemoryStats.Stats["cache"]
+func stringPtr(value string) *string {
+	return &value
+}
 
-	// Calculate network I/O
-	var rx, tx uint64
-	for _, network := range v.Networks {
-		rx += network.RxBytes
-		tx += network.TxBytes
-	}
+func (c *Client) StartContainer(ctx context.Context, containerID string) error {
+	ctx, cancel := c.withTimeout(ctx, 0)
+	defer cancel()
+	return c.dockerCli.ContainerStart(ctx, containerID, types.ContainerStartOptions{})
+}
 
-	return &apiclient.MetricItem{
-		ContainerId:      containerID,
-		CpuUsagePercent:  cpuUsage,
-		MemoryUsageBytes: int64(memUsage),
-		NetworkRxBytes:   int64(rx),
-		NetworkTxBytes:   int64(tx),
-	}, nil
+// StopContainer stops the container, killing it if it has not exited after
+// timeout. A nil timeout uses the configured StopTimeout.
+func (c *Client) StopContainer(ctx context.Context, containerID string, timeout *time.Duration) error {
+	grace := c.StopGrace(timeout)
+	ctx, cancel := c.withTimeout(ctx, grace)
+	defer cancel()
+	seconds := int(grace / time.Second)
+	return c.dockerCli.ContainerStop(ctx, containerID, container.StopOptions{Timeout: &seconds})
 }
 
-func (c *Client) StreamContainerLogs(ctx context.Context, containerID string, logChan chan<- apiclient.LogItem) error {
-	options := container.LogsOptions{
-		ShowStdout: true,
-		ShowStderr: true,
-		Follow:     true,
-		Tail:       "50",
-	}
+// RestartContainer restarts the container with the same timeout semantics
+// as StopContainer.
+func (c *Client) RestartContainer(ctx context.Context, containerID string, timeout *time.Duration) error {
+	grace := c.StopGrace(timeout)
+	ctx, cancel := c.withTimeout(ctx, grace)
+	defer cancel()
+	seconds := int(grace / time.Second)
+	return c.dockerCli.ContainerRestart(ctx, containerID, container.StopOptions{Timeout: &seconds})
+}
 
-	logs, err := c.dockerCli.ContainerLogs(ctx, containerID, options)
-	if err != nil {
-		return fmt.Errorf("failed to attach logs: %w", err)
-	}
-	defer logs.Close()
+func (c *Client) PauseContainer(ctx context.Context, containerID string) error {
+	ctx, cancel := c.withTimeout(ctx, 0)
+	defer cancel()
+	return c.dockerCli.ContainerPause(ctx, containerID)
+}
 
-	// Docker log streams are multiplexed. The first 8 bytes of each frame contain the stream type and size.
-	hdr := make([]byte, 8)
-	for {
-		_, err := io.ReadFull(logs, hdr)
-		if err != nil {
-			if err == io.EOF {
-				return nil
-			}
-			return err
-		}
+func (c *Client) UnpauseContainer(ctx context.Context, containerID string) error {
+	ctx, cancel := c.withTimeout(ctx, 0)
+	defer cancel()
+	return c.dockerCli.ContainerUnpause(ctx, containerID)
+}
 
-		streamType := "stdout"
-		if hdr[0] == 2 {
-			streamType = "stderr"
-		}
+// KillContainer sends signal (e.g. "SIGHUP" or "9") to the container's main
+// process. An empty signal lets Docker send SIGKILL.
+func (c *Client) KillContainer(ctx context.Context, containerID, signal string) error {
+	ctx, cancel := c.withTimeout(ctx, 0)
+	defer cancel()
+	return c.dockerCli.ContainerKill(ctx, containerID, signal)
+}
 
-		count := binary.BigEndian.Uint32(hdr[4:8])
-		dat := make([]byte, count)
-		_, err = io.ReadFull(logs, dat)
-		if err != nil {
-			return err
-		}
+// RemoveContainer deletes the container. force kills it first if it is
+// running; volumes also removes its anonymous volumes.
+func (c *Client) RemoveContainer(ctx context.Context, containerID string, force, volumes bool) error {
+	ctx, cancel := c.withTimeout(ctx, 0)
+	defer cancel()
+	return c.dockerCli.ContainerRemove(ctx, containerID, container.RemoveOptions{
+		Force:         force,
+		RemoveVolumes: volumes,
+	})
+}
 
-		logChan <- apiclient.LogItem{
-			ContainerId: containerID,
-			Stream:      streamType,
-			Message:     strings.TrimSuffix(string(dat), "\n"),
+// ContainerState returns the container's current state ("running",
+// "paused", ...). It returns "removed" when the container no longer exists.
+func (c *Client) ContainerState(ctx context.Context, containerID string) (string, error) {
+	ctx, cancel := c.withTimeout(ctx, 0)
+	defer cancel()
+	inspect, err := c.dockerCli.ContainerInspect(ctx, containerID)
+	if err != nil {
+		if client.IsErrNotFound(err) {
+			return "removed", nil
 		}
+		return "", fmt.Errorf("failed to inspect container %s: %w", containerID, err)
+	}
+	if inspect.ContainerJSONBase == nil || inspect.State == nil {
+		return "", nil
 	}
+	return inspect.State.Status, nil
 }
 
-func (c *Client) StartContainer(ctx context.Context, containerID string) error {
-	return c.dockerCli.ContainerStart(ctx, containerID, types.ContainerStartOptions{})
+// ContainerRef identifies a container resolved from a full ID, short ID or
+// name.
+type ContainerRef struct {
+	Id     string
+	Name   string
+	Image  string
+	Labels map[string]string
 }
 
-func (c *Client) StopContainer(ctx context.Context, containerID string) error {
-	timeout := 10 // 10 seconds before kill
-	return c.dockerCli.ContainerStop(ctx, containerID, container.StopOptions{Timeout: &timeout})
+// ResolveContainer looks up a container by anything Docker accepts as a
+// reference. It returns nil without an error when no container matches.
+func (c *Client) ResolveContainer(ctx context.Context, ref string) (*ContainerRef, error) {
+	ctx, cancel := c.withTimeout(ctx, 0)
+	defer cancel()
+	inspect, err := c.dockerCli.ContainerInspect(ctx, ref)
+	if client.IsErrNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to inspect container %s: %w", ref, err)
+	}
+	if inspect.ContainerJSONBase == nil {
+		return nil, nil
+	}
+	resolved := &ContainerRef{
+		Id:   inspect.ID,
+		Name: strings.TrimPrefix(inspect.Name, "/"),
+	}
+	if inspect.Config != nil {
+		resolved.Image = inspect.Config.Image
+		resolved.Labels = inspect.Config.Labels
+	}
+	return resolved, nil
 }
 
-func (c *Client) RestartContainer(ctx context.Context, containerID string) error {
-	timeout := 10
-	return c.dockerCli.ContainerRestart(ctx, containerID, container.StopOptions{Timeout: &timeout})
+// StopGrace returns the grace period a stop with timeout will use.
+func (c *Client) StopGrace(timeout *time.Duration) time.Duration {
+	if timeout != nil {
+		return *timeout
+	}
+	return c.opts.StopTimeout
 }
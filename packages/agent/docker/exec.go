@@ -0,0 +1,79 @@
+package docker
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+)
+
+// ExecOptions describes a command to run inside a running container.
+type ExecOptions struct {
+	Cmd        []string
+	Tty        bool
+	Env        []string
+	User       string
+	WorkingDir string
+	Cols       uint
+	Rows       uint
+}
+
+// ExecAttach creates an exec instance and attaches to its stdin, stdout and
+// stderr. The caller owns the returned connection and must Close it. Without
+// a TTY the output is multiplexed with the usual 8-byte stream headers.
+func (c *Client) ExecAttach(ctx context.Context, containerID string, opts ExecOptions) (string, types.HijackedResponse, error) {
+	var consoleSize *[2]uint
+	if opts.Tty && opts.Cols > 0 && opts.Rows > 0 {
+		consoleSize = &[2]uint{opts.Rows, opts.Cols}
+	}
+
+	createCtx, cancel := c.withTimeout(ctx, 0)
+	defer cancel()
+	created, err := c.dockerCli.ContainerExecCreate(createCtx, containerID, types.ExecConfig{
+		Cmd:          opts.Cmd,
+		Tty:          opts.Tty,
+		Env:          opts.Env,
+		User:         opts.User,
+		WorkingDir:   opts.WorkingDir,
+		ConsoleSize:  consoleSize,
+		AttachStdin:  true,
+		AttachStdout: true,
+		AttachStderr: true,
+	})
+	if err != nil {
+		return "", types.HijackedResponse{}, fmt.Errorf("failed to create exec in container %s: %w", containerID, err)
+	}
+
+	// The attach itself streams for the life of the session, so it gets no
+	// timeout.
+	conn, err := c.dockerCli.ContainerExecAttach(ctx, created.ID, types.ExecStartCheck{
+		Tty:         opts.Tty,
+		ConsoleSize: consoleSize,
+	})
+	if err != nil {
+		return "", types.HijackedResponse{}, fmt.Errorf("failed to attach to exec %s: %w", created.ID, err)
+	}
+	return created.ID, conn, nil
+}
+
+func (c *Client) ExecResize(ctx context.Context, execID string, cols, rows uint) error {
+	ctx, cancel := c.withTimeout(ctx, 0)
+	defer cancel()
+	return c.dockerCli.ContainerExecResize(ctx, execID, container.ResizeOptions{
+		Height: rows,
+		Width:  cols,
+	})
+}
+
+// ExecExitCode returns the exit code of a finished exec. running is true
+// when the process is still alive, in which case the code is meaningless.
+func (c *Client) ExecExitCode(ctx context.Context, execID string) (code int, running bool, err error) {
+	ctx, cancel := c.withTimeout(ctx, 0)
+	defer cancel()
+	inspect, err := c.dockerCli.ContainerExecInspect(ctx, execID)
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to inspect exec %s: %w", execID, err)
+	}
+	return inspect.ExitCode, inspect.Running, nil
+}
@@ -0,0 +1,241 @@
+package docker
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	apiclient "docker-dashboard-agent/client"
+	"github.com/docker/docker/api/types/container"
+)
+
+// DefaultLogMaxLine is used when Options.LogMaxLine is not set.
+const DefaultLogMaxLine = 64 * 1024
+
+// StreamContainerLogs follows a container's logs. With a non-zero since the
+// stream starts at lines stamped since or later, inclusive; otherwise it
+// starts with the configured LogTail.
+func (c *Client) StreamContainerLogs(ctx context.Context, containerID string, since time.Time, logChan chan<- apiclient.LogItem) error {
+	// A TTY container's logs are a single raw stream instead of stdcopy
+	// frames.
+	inspectCtx, cancel := c.withTimeout(ctx, 0)
+	inspect, err := c.dockerCli.ContainerInspect(inspectCtx, containerID)
+	cancel()
+	if err != nil {
+		return fmt.Errorf("failed to inspect container %s: %w", containerID, err)
+	}
+	tty := inspect.Config != nil && inspect.Config.Tty
+
+	options := container.LogsOptions{
+		ShowStdout: true,
+		ShowStderr: true,
+		Follow:     true,
+		Timestamps: true,
+		Tail:       c.opts.LogTail,
+	}
+	if !since.IsZero() {
+		options.Since = since.Format(time.RFC3339Nano)
+		options.Tail = "all"
+	}
+
+	logs, err := c.dockerCli.ContainerLogs(ctx, containerID, options)
+	if err != nil {
+		return fmt.Errorf("failed to attach logs: %w", err)
+	}
+	defer logs.Close()
+
+	maxLine := c.opts.LogMaxLine
+	if maxLine <= 0 {
+		maxLine = DefaultLogMaxLine
+	}
+	emit := func(stream, line string) error {
+		timestamp, message := splitTimestamp(line)
+		select {
+		case logChan <- apiclient.LogItem{
+			ContainerId: containerID,
+			Stream:      stream,
+			Message:     message,
+			Timestamp:   timestamp.Format(time.RFC3339Nano),
+		}:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	if tty {
+		err = readRawLogs(logs, maxLine, emit)
+	} else {
+		err = readMultiplexedLogs(logs, maxLine, emit)
+	}
+	if ctx.Err() != nil {
+		return nil
+	}
+	return err
+}
+
+// readMultiplexedLogs reads stdcopy frames: an 8-byte header holding the
+// stream type and the payload size, then the payload. Payloads larger than
+// maxLine are truncated and the rest of the frame is skipped, so a corrupt
+// size cannot make it allocate arbitrary memory.
+func readMultiplexedLogs(r io.Reader, maxLine int, emit func(stream, line string) error) error {
+	hdr := make([]byte, 8)
+	buf := make([]byte, maxLine)
+	for {
+		if _, err := io.ReadFull(r, hdr); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return fmt.Errorf("failed to read log frame header: %w", err)
+		}
+
+		var stream string
+		switch hdr[0] {
+		case 0, 1:
+			stream = "stdout"
+		case 2:
+			stream = "stderr"
+		default:
+			return fmt.Errorf("invalid log frame header %x", hdr)
+		}
+
+		count := int64(binary.BigEndian.Uint32(hdr[4:8]))
+		n := count
+		if n > int64(maxLine) {
+			n = int64(maxLine)
+		}
+		if _, err := io.ReadFull(r, buf[:n]); err != nil {
+			return fmt.Errorf("failed to read log frame: %w", err)
+		}
+		if skipped := count - n; skipped > 0 {
+			// The last byte is read separately so a trailing newline is not
+			// counted as dropped.
+			if _, err := io.CopyN(io.Discard, r, skipped-1); err != nil {
+				return fmt.Errorf("failed to read log frame: %w", err)
+			}
+			if _, err := io.ReadFull(r, hdr[:1]); err != nil {
+				return fmt.Errorf("failed to read log frame: %w", err)
+			}
+			if hdr[0] == '\n' {
+				skipped--
+			}
+			if err := emit(stream, truncated(buf[:n], skipped)); err != nil {
+				return err
+			}
+			continue
+		}
+
+		// Each frame normally carries one line, but nothing guarantees it.
+		payload := strings.TrimSuffix(string(buf[:n]), "\n")
+		for _, line := range strings.Split(payload, "\n") {
+			if err := emit(stream, line); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// readRawLogs reads the newline-delimited output of a TTY container, which
+// has no stderr. Lines longer than maxLine, not counting the line ending, are
+// truncated.
+func readRawLogs(r io.Reader, maxLine int, emit func(stream, line string) error) error {
+	// Room for a full line plus its \r\n.
+	br := bufio.NewReaderSize(r, maxLine+2)
+	for {
+		line, err := br.ReadSlice('\n')
+		var text string
+		switch {
+		case errors.Is(err, bufio.ErrBufferFull):
+			// Keep the first maxLine bytes and drop the rest of the line.
+			kept := []byte(string(line[:maxLine]))
+			var skipped int64
+			skipped, err = discardLine(br)
+			text = truncated(kept, skipped+int64(len(line)-maxLine))
+		case len(line) == 0:
+			return endOfRawLogs(err)
+		default:
+			text = strings.TrimSuffix(strings.TrimSuffix(string(line), "\n"), "\r")
+			if len(text) > maxLine {
+				text = truncated([]byte(text[:maxLine]), int64(len(text)-maxLine))
+			}
+		}
+		if emitErr := emit("stdout", text); emitErr != nil {
+			return emitErr
+		}
+		if err != nil {
+			return endOfRawLogs(err)
+		}
+	}
+}
+
+// discardLine skips to just past the next newline and returns how many
+// bytes it skipped, not counting the line ending.
+func discardLine(br *bufio.Reader) (int64, error) {
+	var skipped int64
+	var prev byte
+	for {
+		chunk, err := br.ReadSlice('\n')
+		if errors.Is(err, bufio.ErrBufferFull) {
+			skipped += int64(len(chunk))
+			prev = chunk[len(chunk)-1]
+			continue
+		}
+		if err != nil {
+			return skipped + int64(len(chunk)), err
+		}
+		// The \r of a \r\n may have ended the previous chunk.
+		content := chunk[:len(chunk)-1]
+		if len(content) > 0 {
+			prev = content[len(content)-1]
+		}
+		skipped += int64(len(content))
+		if prev == '\r' {
+			skipped--
+		}
+		return skipped, nil
+	}
+}
+
+func endOfRawLogs(err error) error {
+	if err == io.EOF {
+		return nil
+	}
+	return fmt.Errorf("failed to read logs: %w", err)
+}
+
+// truncated returns the kept part of a line, cut back to a whole UTF-8
+// character, followed by a marker saying how much was dropped.
+func truncated(kept []byte, skipped int64) string {
+	cut := len(kept)
+	for i := cut - 1; i >= 0 && i >= cut-utf8.UTFMax; i-- {
+		if utf8.RuneStart(kept[i]) {
+			if !utf8.FullRune(kept[i:]) {
+				cut = i
+			}
+			break
+		}
+	}
+	skipped += int64(len(kept) - cut)
+	return fmt.Sprintf("%s... [truncated %d bytes]", kept[:cut], skipped)
+}
+
+// splitTimestamp separates the RFC3339Nano timestamp Docker prefixes to each
+// line when Timestamps is requested. A line without one is stamped with the
+// current time.
+func splitTimestamp(line string) (time.Time, string) {
+	if i := strings.IndexByte(line, ' '); i > 0 {
+		if t, err := time.Parse(time.RFC3339Nano, line[:i]); err == nil {
+			return t.UTC(), line[i+1:]
+		}
+	} else if t, err := time.Parse(time.RFC3339Nano, line); err == nil {
+		// An empty line is just the timestamp.
+		return t.UTC(), ""
+	}
+	return time.Now().UTC(), line
+}
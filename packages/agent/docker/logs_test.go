@@ -0,0 +1,154 @@
+package docker
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+type logLine struct {
+	stream string
+	line   string
+}
+
+func loadLogFixture(t *testing.T, name string) []byte {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatalf("read fixture: %v", err)
+	}
+	return data
+}
+
+func collectLines(lines *[]logLine) func(stream, line string) error {
+	return func(stream, line string) error {
+		*lines = append(*lines, logLine{stream, line})
+		return nil
+	}
+}
+
+func TestReadMultiplexedLogs(t *testing.T) {
+	var got []logLine
+	err := readMultiplexedLogs(bytes.NewReader(loadLogFixture(t, "logs_multiplexed.bin")), 64, collectLines(&got))
+	if err != nil {
+		t.Fatalf("readMultiplexedLogs: %v", err)
+	}
+
+	want := []logLine{
+		{"stdout", "2024-05-01T12:00:00.000000001Z starting server"},
+		{"stderr", "2024-05-01T12:00:00.100000000Z warning: config not found"},
+		{"stdout", "2024-05-01T12:00:01.000000000Z "},
+		// 31 bytes of timestamp and 33 of the 100 x's fit in 64 bytes.
+		{"stdout", "2024-05-01T12:00:02.000000000Z " + strings.Repeat("x", 33) + "... [truncated 67 bytes]"},
+		{"stdout", "2024-05-01T12:00:03.000000000Z listening on :8080"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("lines =\n%q\nwant\n%q", got, want)
+	}
+}
+
+func TestReadMultiplexedLogsRejectsCorruptFrames(t *testing.T) {
+	// A header claiming a 4GiB payload must not be allocated; the short
+	// stream ends the read instead.
+	huge := []byte{1, 0, 0, 0, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(huge[4:], 0xffffffff)
+	huge = append(huge, "2024-05-01T12:00:00Z short"...)
+
+	tests := map[string][]byte{
+		"oversized frame": huge,
+		"bad stream type": append([]byte{'2', '0', '2', '4', 0, 0, 0, 5}, "hello"...),
+		"short header":    {1, 0, 0},
+	}
+	for name, data := range tests {
+		t.Run(name, func(t *testing.T) {
+			var got []logLine
+			if err := readMultiplexedLogs(bytes.NewReader(data), 1024, collectLines(&got)); err == nil {
+				t.Errorf("readMultiplexedLogs succeeded with %q", got)
+			}
+		})
+	}
+}
+
+func TestReadRawLogs(t *testing.T) {
+	var got []logLine
+	err := readRawLogs(bytes.NewReader(loadLogFixture(t, "logs_tty.bin")), 64, collectLines(&got))
+	if err != nil {
+		t.Fatalf("readRawLogs: %v", err)
+	}
+
+	want := []logLine{
+		{"stdout", "2024-05-01T12:00:00.000000001Z starting server"},
+		{"stdout", "2024-05-01T12:00:00.500000000Z \x1b[33mwarning\x1b[0m: no config"},
+		{"stdout", "2024-05-01T12:00:02.000000000Z " + strings.Repeat("y", 33) + "... [truncated 67 bytes]"},
+		{"stdout", "2024-05-01T12:00:03.000000000Z listening on :8080"},
+		{"stdout", "2024-05-01T12:00:04.000000000Z partial"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("lines =\n%q\nwant\n%q", got, want)
+	}
+}
+
+func TestReadRawLogsIsNotMultiplexed(t *testing.T) {
+	// TTY output starting with bytes that look like a stdcopy header must
+	// come through as text rather than as a frame size.
+	data := "\x01\x00\x00\x00\xff\xff\xff\xffweird\nnext\n"
+	var got []logLine
+	if err := readRawLogs(strings.NewReader(data), 1024, collectLines(&got)); err != nil {
+		t.Fatalf("readRawLogs: %v", err)
+	}
+	want := []logLine{
+		{"stdout", "\x01\x00\x00\x00\xff\xff\xff\xffweird"},
+		{"stdout", "next"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("lines = %q, want %q", got, want)
+	}
+}
+
+func TestReadRawLogsLineEndingsDoNotCount(t *testing.T) {
+	// A 64-byte line fits in 64 bytes even though its \r\n does not; a
+	// longer one has the \r\n straddle the reader's buffer when dropped.
+	exact := strings.Repeat("a", 64)
+	long := strings.Repeat("b", 64+2+65)
+	data := exact + "\r\n" + long + "\r\nend\r\n"
+
+	var got []logLine
+	if err := readRawLogs(strings.NewReader(data), 64, collectLines(&got)); err != nil {
+		t.Fatalf("readRawLogs: %v", err)
+	}
+	want := []logLine{
+		{"stdout", exact},
+		{"stdout", strings.Repeat("b", 64) + "... [truncated 67 bytes]"},
+		{"stdout", "end"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("lines = %q, want %q", got, want)
+	}
+}
+
+func TestTruncatedKeepsWholeCharacters(t *testing.T) {
+	// "é" is two bytes; cutting after its first byte moves it to the
+	// dropped part.
+	got := truncated([]byte("caf\xc3"), 10)
+	if want := "caf... [truncated 11 bytes]"; got != want {
+		t.Errorf("truncated = %q, want %q", got, want)
+	}
+}
+
+func TestSplitTimestamp(t *testing.T) {
+	ts, msg := splitTimestamp("2024-05-01T12:00:00.123456789Z hello world")
+	if want := time.Date(2024, 5, 1, 12, 0, 0, 123456789, time.UTC); !ts.Equal(want) || msg != "hello world" {
+		t.Errorf("splitTimestamp = %v, %q", ts, msg)
+	}
+
+	before := time.Now()
+	ts, msg = splitTimestamp("no timestamp here")
+	if ts.Before(before) || msg != "no timestamp here" {
+		t.Errorf("splitTimestamp without timestamp = %v, %q", ts, msg)
+	}
+}
@@ -0,0 +1,155 @@
+package docker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	apiclient "docker-dashboard-agent/client"
+	"github.com/docker/docker/api/types"
+)
+
+// GetContainerStats takes a single stats sample. The daemon needs about a
+// second to prime precpu_stats, so prefer StreamContainerStats for anything
+// periodic.
+func (c *Client) GetContainerStats(ctx context.Context, containerID string) (*apiclient.MetricItem, error) {
+	stats, err := c.dockerCli.ContainerStats(ctx, containerID, false)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get stats: %w", err)
+	}
+	defer stats.Body.Close()
+
+	var v types.StatsJSON
+	if err := json.NewDecoder(stats.Body).Decode(&v); err != nil {
+		return nil, fmt.Errorf("failed to decode stats: %w", err)
+	}
+
+	item := metricFromStats(containerID, &v)
+	return &item, nil
+}
+
+// StreamContainerStats keeps a streaming stats request open and calls fn
+// with every sample (roughly one per second) until ctx is cancelled or the
+// container stops, in which case it returns nil.
+func (c *Client) StreamContainerStats(ctx context.Context, containerID string, fn func(apiclient.MetricItem)) error {
+	stats, err := c.dockerCli.ContainerStats(ctx, containerID, true)
+	if err != nil {
+		return fmt.Errorf("failed to stream stats: %w", err)
+	}
+	defer stats.Body.Close()
+
+	decoder := json.NewDecoder(stats.Body)
+	for {
+		var v types.StatsJSON
+		if err := decoder.Decode(&v); err != nil {
+			if err == io.EOF || ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("failed to decode stats: %w", err)
+		}
+		// The first streamed sample has no precpu_stats to diff against.
+		if v.PreCPUStats.SystemUsage == 0 {
+			continue
+		}
+		fn(metricFromStats(containerID, &v))
+	}
+}
+
+func metricFromStats(containerID string, v *types.StatsJSON) apiclient.MetricItem {
+	// Calculate network I/O
+	var rx, tx uint64
+	for _, network := range v.Networks {
+		rx += network.RxBytes
+		tx += network.TxBytes
+	}
+
+	memUsage := memoryWorkingSet(v.MemoryStats)
+
+	item := apiclient.MetricItem{
+		ContainerId:      containerID,
+		CpuUsagePercent:  cpuPercent(v),
+		MemoryUsageBytes: int64(memUsage),
+		NetworkRxBytes:   int64(rx),
+		NetworkTxBytes:   int64(tx),
+	}
+
+	// Block I/O, summed over devices. cgroup v1 spells ops "Read"/"Write",
+	// v2 "read"/"write", and v2 has no io_serviced_recursive at all.
+	if entries := v.BlkioStats.IoServiceBytesRecursive; len(entries) > 0 {
+		read, write := sumBlkio(entries)
+		item.BlockReadBytes, item.BlockWriteBytes = &read, &write
+	}
+	if entries := v.BlkioStats.IoServicedRecursive; len(entries) > 0 {
+		read, write := sumBlkio(entries)
+		item.BlockReadOps, item.BlockWriteOps = &read, &write
+	}
+
+	if v.PidsStats.Current > 0 {
+		pids := int64(v.PidsStats.Current)
+		item.PidsCurrent = &pids
+	}
+
+	if v.MemoryStats.Limit > 0 {
+		limit := int64(v.MemoryStats.Limit)
+		percent := float64(memUsage) / float64(v.MemoryStats.Limit) * 100.0
+		item.MemoryLimitBytes = &limit
+		item.MemoryPercent = &percent
+	}
+
+	if throttling := v.CPUStats.ThrottlingData; throttling.Periods > 0 {
+		periods := int64(throttling.ThrottledPeriods)
+		throttledTime := int64(throttling.ThrottledTime)
+		item.CpuThrottledPeriods = &periods
+		item.CpuThrottledTimeNs = &throttledTime
+	}
+
+	return item
+}
+
+func sumBlkio(entries []types.BlkioStatEntry) (read, write int64) {
+	for _, entry := range entries {
+		switch strings.ToLower(entry.Op) {
+		case "read":
+			read += int64(entry.Value)
+		case "write":
+			write += int64(entry.Value)
+		}
+	}
+	return read, write
+}
+
+// cpuPercent matches `docker stats`: 100% is one full CPU. cgroup v2 never
+// fills percpu_usage, so online_cpus is authoritative and the percpu count
+// is only a fallback for daemons older than API 1.27.
+func cpuPercent(v *types.StatsJSON) float64 {
+	onlineCPUs := float64(v.CPUStats.OnlineCPUs)
+	if onlineCPUs == 0 {
+		onlineCPUs = float64(len(v.CPUStats.CPUUsage.PercpuUsage))
+	}
+	if onlineCPUs == 0 {
+		onlineCPUs = 1
+	}
+
+	cpuDelta := float64(v.CPUStats.CPUUsage.TotalUsage) - float64(v.PreCPUStats.CPUUsage.TotalUsage)
+	systemDelta := float64(v.CPUStats.SystemUsage) - float64(v.PreCPUStats.SystemUsage)
+	if systemDelta <= 0.0 || cpuDelta <= 0.0 {
+		return 0.0
+	}
+	return (cpuDelta / systemDelta) * onlineCPUs * 100.0
+}
+
+// memoryWorkingSet is usage minus reclaimable page cache, like `docker
+// stats`. cgroup v1 reports it as total_inactive_file, cgroup v2 as
+// inactive_file; "cache" is v1-only and overstates what can be reclaimed.
+func memoryWorkingSet(mem types.MemoryStats) uint64 {
+	inactive, ok := mem.Stats["total_inactive_file"]
+	if !ok {
+		inactive, ok = mem.Stats["inactive_file"]
+	}
+	if !ok || inactive > mem.Usage {
+		return mem.Usage
+	}
+	return mem.Usage - inactive
+}
@@ -0,0 +1,163 @@
+package docker
+
+import (
+	"encoding/json"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+)
+
+func loadStatsFixture(t *testing.T, name string) *types.StatsJSON {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatalf("read fixture: %v", err)
+	}
+	var v types.StatsJSON
+	if err := json.Unmarshal(data, &v); err != nil {
+		t.Fatalf("decode fixture: %v", err)
+	}
+	return &v
+}
+
+func TestMetricFromStats(t *testing.T) {
+	tests := []struct {
+		fixture    string
+		wantCPU    float64
+		wantMemory int64
+		wantRx     int64
+		wantTx     int64
+	}{
+		// 2e8ns of 4e9ns system time across 4 CPUs; 100MiB usage minus
+		// 20MiB total_inactive_file.
+		{"stats_cgroup_v1.json", 20.0, 83886080, 1048576, 524288},
+		// No percpu_usage on cgroup v2: 1e8ns of 8e9ns across 8 online CPUs;
+		// 200MiB usage minus 50MiB inactive_file.
+		{"stats_cgroup_v2.json", 10.0, 157286400, 4194304, 3145728},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.fixture, func(t *testing.T) {
+			got := metricFromStats("abc", loadStatsFixture(t, tt.fixture))
+
+			if math.Abs(got.CpuUsagePercent-tt.wantCPU) > 1e-9 {
+				t.Errorf("CpuUsagePercent = %v, want %v", got.CpuUsagePercent, tt.wantCPU)
+			}
+			if got.MemoryUsageBytes != tt.wantMemory {
+				t.Errorf("MemoryUsageBytes = %d, want %d", got.MemoryUsageBytes, tt.wantMemory)
+			}
+			if got.NetworkRxBytes != tt.wantRx || got.NetworkTxBytes != tt.wantTx {
+				t.Errorf("network = %d/%d, want %d/%d", got.NetworkRxBytes, got.NetworkTxBytes, tt.wantRx, tt.wantTx)
+			}
+		})
+	}
+}
+
+func TestCPUPercentFallsBackToPercpuCount(t *testing.T) {
+	// Daemons older than API 1.27 do not send online_cpus.
+	v := loadStatsFixture(t, "stats_cgroup_v1.json")
+	v.CPUStats.OnlineCPUs = 0
+
+	if got := cpuPercent(v); math.Abs(got-20.0) > 1e-9 {
+		t.Errorf("cpuPercent = %v, want 20", got)
+	}
+}
+
+func TestCPUPercentWithoutCPUCount(t *testing.T) {
+	v := loadStatsFixture(t, "stats_cgroup_v2.json")
+	v.CPUStats.OnlineCPUs = 0
+
+	// 1e8 / 8e9 on a single assumed CPU.
+	if got := cpuPercent(v); math.Abs(got-1.25) > 1e-9 {
+		t.Errorf("cpuPercent = %v, want 1.25", got)
+	}
+}
+
+func TestCPUPercentWithoutPreviousSample(t *testing.T) {
+	v := loadStatsFixture(t, "stats_cgroup_v2.json")
+	v.PreCPUStats = types.CPUStats{}
+	v.CPUStats.SystemUsage = 0
+
+	if got := cpuPercent(v); got != 0 {
+		t.Errorf("cpuPercent = %v, want 0", got)
+	}
+}
+
+func TestMemoryWorkingSet(t *testing.T) {
+	tests := []struct {
+		name string
+		mem  types.MemoryStats
+		want uint64
+	}{
+		{"no stats", types.MemoryStats{Usage: 1000}, 1000},
+		{"cgroup v1", types.MemoryStats{Usage: 1000, Stats: map[string]uint64{"cache": 600, "total_inactive_file": 200}}, 800},
+		{"cgroup v2", types.MemoryStats{Usage: 1000, Stats: map[string]uint64{"inactive_file": 300}}, 700},
+		{"inactive exceeds usage", types.MemoryStats{Usage: 100, Stats: map[string]uint64{"inactive_file": 300}}, 100},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := memoryWorkingSet(tt.mem); got != tt.want {
+				t.Errorf("memoryWorkingSet = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMetricFromStatsExtendedFields(t *testing.T) {
+	v1 := metricFromStats("abc", loadStatsFixture(t, "stats_cgroup_v1.json"))
+	assertInt64(t, "v1 BlockReadBytes", v1.BlockReadBytes, 4096000)
+	assertInt64(t, "v1 BlockWriteBytes", v1.BlockWriteBytes, 1228800)
+	assertInt64(t, "v1 BlockReadOps", v1.BlockReadOps, 250)
+	assertInt64(t, "v1 BlockWriteOps", v1.BlockWriteOps, 75)
+	assertInt64(t, "v1 PidsCurrent", v1.PidsCurrent, 12)
+	assertInt64(t, "v1 MemoryLimitBytes", v1.MemoryLimitBytes, 536870912)
+	assertInt64(t, "v1 CpuThrottledPeriods", v1.CpuThrottledPeriods, 30)
+	assertInt64(t, "v1 CpuThrottledTimeNs", v1.CpuThrottledTimeNs, 450000000)
+	if v1.MemoryPercent == nil || math.Abs(*v1.MemoryPercent-15.625) > 1e-9 {
+		t.Errorf("v1 MemoryPercent = %v, want 15.625", v1.MemoryPercent)
+	}
+
+	// cgroup v2 sums lowercase ops across both devices and has no op counts.
+	v2 := metricFromStats("abc", loadStatsFixture(t, "stats_cgroup_v2.json"))
+	assertInt64(t, "v2 BlockReadBytes", v2.BlockReadBytes, 9216000)
+	assertInt64(t, "v2 BlockWriteBytes", v2.BlockWriteBytes, 2048000)
+	if v2.BlockReadOps != nil || v2.BlockWriteOps != nil {
+		t.Errorf("v2 block ops = %v/%v, want nil", v2.BlockReadOps, v2.BlockWriteOps)
+	}
+	assertInt64(t, "v2 PidsCurrent", v2.PidsCurrent, 37)
+	assertInt64(t, "v2 CpuThrottledPeriods", v2.CpuThrottledPeriods, 12)
+	if v2.MemoryPercent == nil || math.Abs(*v2.MemoryPercent-14.6484375) > 1e-9 {
+		t.Errorf("v2 MemoryPercent = %v, want 14.6484375", v2.MemoryPercent)
+	}
+}
+
+func TestMetricFromStatsOmitsUnreportedFields(t *testing.T) {
+	item := metricFromStats("abc", &types.StatsJSON{})
+
+	data, err := json.Marshal(item)
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	if len(fields) != 5 {
+		t.Errorf("got fields %v, want only the five base fields", fields)
+	}
+}
+
+func assertInt64(t *testing.T, name string, got *int64, want int64) {
+	t.Helper()
+	if got == nil {
+		t.Errorf("%s = nil, want %d", name, want)
+		return
+	}
+	if *got != want {
+		t.Errorf("%s = %d, want %d", name, *got, want)
+	}
+}
@@ -0,0 +1,485 @@
+package docker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/mount"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/client"
+	"github.com/docker/go-connections/nat"
+)
+
+// ProgressFunc receives progress for a long-running operation. Stage names
+// the step ("pull", "recreate", "start", "healthcheck", "rollback");
+// current and total are byte counts during a pull and zero otherwise.
+type ProgressFunc func(stage, message string, current, total int64)
+
+// UpdateOptions tunes UpdateContainer. A nil StopTimeout uses the client's
+// StopTimeout.
+type UpdateOptions struct {
+	// Force recreates the container even when the pull brought no new image.
+	Force         bool
+	StopTimeout   *time.Duration
+	HealthTimeout time.Duration
+}
+
+// UpdateResult describes what UpdateContainer did.
+type UpdateResult struct {
+	Image           string
+	PreviousImageId string
+	ImageId         string
+	Updated         bool
+	ContainerId     string
+	PreviousId      string
+	RolledBack      bool
+}
+
+// pullMessage is one line of the ImagePull progress stream.
+type pullMessage struct {
+	ID             string `json:"id"`
+	Status         string `json:"status"`
+	ProgressDetail struct {
+		Current int64 `json:"current"`
+		Total   int64 `json:"total"`
+	} `json:"progressDetail"`
+	ErrorDetail *struct {
+		Message string `json:"message"`
+	} `json:"errorDetail"`
+}
+
+// pullProgressInterval throttles byte-count progress during a pull.
+const pullProgressInterval = 500 * time.Millisecond
+
+// healthPollInterval is how often a recreated container is inspected while
+// waiting for it to settle.
+const healthPollInterval = time.Second
+
+// PullImage pulls ref, reporting aggregated download progress across all
+// layers.
+func (c *Client) PullImage(ctx context.Context, ref string, progress ProgressFunc) error {
+	body, err := c.dockerCli.ImagePull(ctx, ref, types.ImagePullOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to pull image %s: %w", ref, err)
+	}
+	defer body.Close()
+
+	type layer struct{ current, total int64 }
+	layers := make(map[string]*layer)
+	var lastReport time.Time
+
+	decoder := json.NewDecoder(body)
+	for {
+		var msg pullMessage
+		if err := decoder.Decode(&msg); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return fmt.Errorf("failed to read pull progress for %s: %w", ref, err)
+		}
+		if msg.ErrorDetail != nil {
+			return fmt.Errorf("failed to pull image %s: %s", ref, msg.ErrorDetail.Message)
+		}
+
+		if msg.ID != "" && msg.ProgressDetail.Total > 0 && msg.Status == "Downloading" {
+			l, ok := layers[msg.ID]
+			if !ok {
+				l = &layer{}
+				layers[msg.ID] = l
+			}
+			l.current, l.total = msg.ProgressDetail.Current, msg.ProgressDetail.Total
+		} else if l, ok := layers[msg.ID]; ok && (msg.Status == "Download complete" || msg.Status == "Already exists") {
+			l.current = l.total
+		}
+
+		if progress == nil {
+			continue
+		}
+		if msg.ID == "" || time.Since(lastReport) >= pullProgressInterval {
+			var current, total int64
+			for _, l := range layers {
+				current += l.current
+				total += l.total
+			}
+			status := msg.Status
+			if msg.ID != "" {
+				status = msg.ID + ": " + status
+			}
+			progress("pull", status, current, total)
+			lastReport = time.Now()
+		}
+	}
+	return nil
+}
+
+// UpdateContainer pulls the image the container was created from and, when
+// it changed, replaces the container with one built from the same
+// configuration: env, mounts, networks, labels, restart policy and port
+// bindings. The old container is kept, stopped and renamed, until the new one
+// is running and healthy; otherwise the new one is removed and the old one
+// restored. Cancelling ctx interrupts the pull or the health wait; once the
+// old container is being stopped, the recreate runs to completion or rollback
+// regardless.
+func (c *Client) UpdateContainer(ctx context.Context, containerID string, opts UpdateOptions, progress ProgressFunc) (*UpdateResult, error) {
+	if progress == nil {
+		progress = func(string, string, int64, int64) {}
+	}
+
+	old, err := c.inspect(ctx, containerID)
+	if err != nil {
+		return nil, err
+	}
+	if old.HostConfig.AutoRemove {
+		// Stopping it would delete it, leaving nothing to roll back to.
+		return nil, fmt.Errorf("container %s is set to be removed when it stops and cannot be updated in place", strings.TrimPrefix(old.Name, "/"))
+	}
+	ref := old.Config.Image
+	if strings.HasPrefix(ref, "sha256:") {
+		return nil, fmt.Errorf("container %s was created from an image ID, not a pullable reference", old.Name)
+	}
+
+	result := &UpdateResult{
+		Image:           ref,
+		PreviousImageId: old.Image,
+		ContainerId:     old.ID,
+	}
+
+	progress("pull", "Pulling "+ref, 0, 0)
+	if err := c.PullImage(ctx, ref, progress); err != nil {
+		return result, err
+	}
+	pulled, err := c.imageInspect(ctx, ref)
+	if err != nil {
+		return result, err
+	}
+	result.ImageId = pulled.ID
+	if pulled.ID == old.Image && !opts.Force {
+		progress("pull", "Image is up to date", 0, 0)
+		return result, nil
+	}
+
+	oldImage, err := c.imageInspect(ctx, old.Image)
+	if err != nil {
+		// Without the old image we cannot tell inherited defaults apart from
+		// explicit settings; keep everything.
+		oldImage = types.ImageInspect{}
+	}
+	config, hostConfig, primary, extra := recreateConfig(old, oldImage.Config)
+
+	if err := ctx.Err(); err != nil {
+		return result, err
+	}
+	// Giving up half way through would leave the container stopped or
+	// renamed.
+	recreateCtx := context.WithoutCancel(ctx)
+
+	name := strings.TrimPrefix(old.Name, "/")
+	backupName := fmt.Sprintf("%s-old-%d", name, time.Now().Unix())
+	wasRunning := old.State != nil && old.State.Running
+
+	progress("recreate", "Stopping "+name, 0, 0)
+	if err := c.StopContainer(recreateCtx, old.ID, opts.StopTimeout); err != nil {
+		return result, fmt.Errorf("failed to stop container %s: %w", name, err)
+	}
+	if err := c.rename(recreateCtx, old.ID, backupName); err != nil {
+		result.RolledBack = true
+		return result, c.rollback(recreateCtx, "", old.ID, name, false, wasRunning, err)
+	}
+
+	progress("recreate", "Creating "+name, 0, 0)
+	newID, err := c.create(recreateCtx, name, config, hostConfig, primary, extra)
+	if err != nil {
+		result.RolledBack = true
+		return result, c.rollback(recreateCtx, newID, old.ID, name, true, wasRunning, err)
+	}
+
+	// A container that was stopped before the update stays stopped.
+	if wasRunning {
+		progress("start", "Starting "+name, 0, 0)
+		err = c.StartContainer(recreateCtx, newID)
+		if err != nil {
+			err = fmt.Errorf("failed to start new container: %w", err)
+		} else {
+			progress("healthcheck", "Waiting for "+name+" to become healthy", 0, 0)
+			err = c.WaitHealthy(ctx, newID, opts.HealthTimeout)
+		}
+		if err != nil {
+			progress("rollback", "Restoring previous container", 0, 0)
+			result.RolledBack = true
+			return result, c.rollback(ctx, newID, old.ID, name, true, wasRunning, err)
+		}
+	}
+
+	if err := c.removeQuietly(recreateCtx, old.ID); err != nil {
+		progress("recreate", fmt.Sprintf("New container is running but %s could not be removed: %v", backupName, err), 0, 0)
+	}
+	result.Updated = true
+	result.PreviousId = old.ID
+	result.ContainerId = newID
+	return result, nil
+}
+
+// recreateConfig derives the create parameters for a replacement container.
+// Settings the old container merely inherited from its image are dropped so
+// the new image's defaults apply. Anonymous volumes are carried over by name
+// so their data survives.
+func recreateConfig(old types.ContainerJSON, image *container.Config) (*container.Config, *container.HostConfig, *network.NetworkingConfig, map[string]*network.EndpointSettings) {
+	config := *old.Config
+	if image != nil {
+		config.Env = withoutInherited(config.Env, image.Env)
+		if reflect.DeepEqual(config.Cmd, image.Cmd) {
+			config.Cmd = nil
+		}
+		if reflect.DeepEqual(config.Entrypoint, image.Entrypoint) {
+			config.Entrypoint = nil
+		}
+		if config.WorkingDir == image.WorkingDir {
+			config.WorkingDir = ""
+		}
+		if config.User == image.User {
+			config.User = ""
+		}
+		if config.Healthcheck != nil && reflect.DeepEqual(config.Healthcheck, image.Healthcheck) {
+			config.Healthcheck = nil
+		}
+		if len(config.Labels) > 0 {
+			labels := make(map[string]string, len(config.Labels))
+			for k, v := range config.Labels {
+				if imageValue, ok := image.Labels[k]; !ok || imageValue != v {
+					labels[k] = v
+				}
+			}
+			config.Labels = labels
+		}
+		if len(config.ExposedPorts) > 0 {
+			exposed := nat.PortSet{}
+			for port := range config.ExposedPorts {
+				if _, ok := image.ExposedPorts[port]; !ok {
+					exposed[port] = struct{}{}
+				}
+			}
+			config.ExposedPorts = exposed
+		}
+	}
+	// Docker sets the hostname to the short container ID unless one was
+	// given; the new container should get its own.
+	if len(old.ID) >= 12 && config.Hostname == old.ID[:12] {
+		config.Hostname = ""
+	}
+
+	hostConfig := *old.HostConfig
+	explicit := make(map[string]bool)
+	for _, bind := range hostConfig.Binds {
+		parts := strings.Split(bind, ":")
+		if len(parts) >= 2 {
+			explicit[parts[1]] = true
+		}
+	}
+	for _, m := range hostConfig.Mounts {
+		explicit[m.Target] = true
+	}
+	for _, m := range old.Mounts {
+		if m.Type == mount.TypeVolume && m.Name != "" && !explicit[m.Destination] {
+			hostConfig.Binds = append(hostConfig.Binds, m.Name+":"+m.Destination)
+		}
+	}
+
+	// Only one network can be given at create time on older daemons; the
+	// rest are connected afterwards. The daemon attaches the network named
+	// by NetworkMode at create time, "default" meaning bridge, so that one
+	// must not be connected again.
+	createNetwork := string(hostConfig.NetworkMode)
+	if createNetwork == "" || createNetwork == "default" {
+		createNetwork = "bridge"
+	}
+	var primary *network.NetworkingConfig
+	extra := make(map[string]*network.EndpointSettings)
+	if old.NetworkSettings != nil {
+		names := make([]string, 0, len(old.NetworkSettings.Networks))
+		for name := range old.NetworkSettings.Networks {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			endpoint := old.NetworkSettings.Networks[name]
+			settings := &network.EndpointSettings{
+				IPAMConfig: endpoint.IPAMConfig,
+				Links:      endpoint.Links,
+				Aliases:    withoutShortID(endpoint.Aliases, old.ID),
+			}
+			if primary == nil && (name == createNetwork || len(names) == 1) {
+				primary = &network.NetworkingConfig{
+					EndpointsConfig: map[string]*network.EndpointSettings{name: settings},
+				}
+				continue
+			}
+			if name == createNetwork {
+				continue
+			}
+			extra[name] = settings
+		}
+	}
+	return &config, &hostConfig, primary, extra
+}
+
+func withoutInherited(values, inherited []string) []string {
+	fromImage := make(map[string]bool, len(inherited))
+	for _, v := range inherited {
+		fromImage[v] = true
+	}
+	var kept []string
+	for _, v := range values {
+		if !fromImage[v] {
+			kept = append(kept, v)
+		}
+	}
+	return kept
+}
+
+// withoutShortID drops the alias Docker adds for the container's short ID.
+func withoutShortID(aliases []string, id string) []string {
+	var kept []string
+	for _, alias := range aliases {
+		if len(id) >= 12 && alias == id[:12] {
+			continue
+		}
+		kept = append(kept, alias)
+	}
+	return kept
+}
+
+func (c *Client) inspect(ctx context.Context, containerID string) (types.ContainerJSON, error) {
+	ctx, cancel := c.withTimeout(ctx, 0)
+	defer cancel()
+	inspect, err := c.dockerCli.ContainerInspect(ctx, containerID)
+	if err != nil {
+		return types.ContainerJSON{}, fmt.Errorf("failed to inspect container %s: %w", containerID, err)
+	}
+	if inspect.ContainerJSONBase == nil || inspect.Config == nil || inspect.HostConfig == nil {
+		return types.ContainerJSON{}, fmt.Errorf("incomplete inspect data for container %s", containerID)
+	}
+	return inspect, nil
+}
+
+func (c *Client) imageInspect(ctx context.Context, ref string) (types.ImageInspect, error) {
+	ctx, cancel := c.withTimeout(ctx, 0)
+	defer cancel()
+	image, _, err := c.dockerCli.ImageInspectWithRaw(ctx, ref)
+	if err != nil {
+		return types.ImageInspect{}, fmt.Errorf("failed to inspect image %s: %w", ref, err)
+	}
+	return image, nil
+}
+
+func (c *Client) rename(ctx context.Context, containerID, name string) error {
+	ctx, cancel := c.withTimeout(ctx, 0)
+	defer cancel()
+	if err := c.dockerCli.ContainerRename(ctx, containerID, name); err != nil {
+		return fmt.Errorf("failed to rename container %s to %s: %w", containerID, name, err)
+	}
+	return nil
+}
+
+func (c *Client) create(ctx context.Context, name string, config *container.Config, hostConfig *container.HostConfig, primary *network.NetworkingConfig, extra map[string]*network.EndpointSettings) (string, error) {
+	ctx, cancel := c.withTimeout(ctx, 0)
+	defer cancel()
+	created, err := c.dockerCli.ContainerCreate(ctx, config, hostConfig, primary, nil, name)
+	if err != nil {
+		return "", fmt.Errorf("failed to create container %s: %w", name, err)
+	}
+	for networkName, settings := range extra {
+		if err := c.dockerCli.NetworkConnect(ctx, networkName, created.ID, settings); err != nil {
+			return created.ID, fmt.Errorf("failed to connect container %s to network %s: %w", name, networkName, err)
+		}
+	}
+	return created.ID, nil
+}
+
+// WaitHealthy waits until the container reports healthy or, without a
+// healthcheck, is still running after a short settling period. It fails as
+// soon as the container exits or turns unhealthy, or when timeout passes.
+func (c *Client) WaitHealthy(ctx context.Context, containerID string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	settleUntil := time.Now().Add(updateSettleTime)
+	for {
+		inspect, err := c.inspect(ctx, containerID)
+		if err != nil {
+			return err
+		}
+		state := inspect.State
+		if state == nil || !state.Running {
+			exitCode := 0
+			if state != nil {
+				exitCode = state.ExitCode
+			}
+			return fmt.Errorf("new container exited with code %d", exitCode)
+		}
+		if state.Health != nil {
+			switch state.Health.Status {
+			case types.Healthy:
+				return nil
+			case types.Unhealthy:
+				return fmt.Errorf("new container is unhealthy")
+			}
+		} else if time.Now().After(settleUntil) {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("new container did not become healthy within %s", timeout)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(healthPollInterval):
+		}
+	}
+}
+
+// updateSettleTime is how long a recreated container without a healthcheck
+// must keep running before the update counts as successful.
+const updateSettleTime = 5 * time.Second
+
+// rollback undoes a partial update: it removes the replacement container,
+// if one was created, gives the old container its name back and restarts it
+// if it was running. Rollback runs even if ctx was cancelled. Any rollback
+// failure is appended to cause, since it needs manual attention.
+func (c *Client) rollback(ctx context.Context, newID, oldID, name string, renamed, start bool, cause error) error {
+	ctx = context.WithoutCancel(ctx)
+	var problems []string
+	if newID != "" {
+		if err := c.RemoveContainer(ctx, newID, true, false); err != nil {
+			problems = append(problems, fmt.Sprintf("failed to remove new container: %v", err))
+		}
+	}
+	if renamed {
+		if err := c.rename(ctx, oldID, name); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+	if start {
+		if err := c.StartContainer(ctx, oldID); err != nil {
+			problems = append(problems, fmt.Sprintf("failed to restart previous container: %v", err))
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%w; rollback incomplete: %s", cause, strings.Join(problems, "; "))
+	}
+	return cause
+}
+
+func (c *Client) removeQuietly(ctx context.Context, containerID string) error {
+	err := c.RemoveContainer(ctx, containerID, true, false)
+	if client.IsErrNotFound(err) {
+		return nil
+	}
+	return err
+}
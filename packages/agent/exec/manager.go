@@ -0,0 +1,357 @@
+package exec
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	apiclient "docker-dashboard-agent/client"
+	"docker-dashboard-agent/docker"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/pkg/stdcopy"
+)
+
+const (
+	// inputBuffer is how many stdin/resize frames may queue for a session
+	// before it is closed for falling behind.
+	inputBuffer = 256
+
+	stdinWriteTimeout = 10 * time.Second
+	idleCheckInterval = 10 * time.Second
+	outputChunkSize   = 32 * 1024
+)
+
+// Manager runs interactive exec sessions requested over the agent
+// WebSocket. Each session is keyed by the cloud's session ID; frames for a
+// session are applied in the order they arrived.
+type Manager struct {
+	docker      *docker.Client
+	send        func(apiclient.ExecMessage) error
+	maxSessions int
+	idleTimeout time.Duration
+
+	// Authorize, if set, is consulted before a session starts and returns
+	// the full ID of the container to run in. A non-nil error refuses the
+	// session with reason "denied".
+	Authorize func(ctx context.Context, containerId string) (string, error)
+
+	mu       sync.Mutex
+	sessions map[string]*session
+}
+
+type session struct {
+	id     string
+	tty    bool
+	input  chan apiclient.ExecMessage
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// lastActive is the UnixNano time of the last stdin or output frame.
+	lastActive atomic.Int64
+
+	mu     sync.Mutex
+	reason string
+}
+
+// NewManager returns a Manager that sends frames with send, allows at most
+// maxSessions concurrent sessions and closes sessions with no input or
+// output for idleTimeout.
+func NewManager(dockerCli *docker.Client, send func(apiclient.ExecMessage) error, maxSessions int, idleTimeout time.Duration) *Manager {
+	return &Manager{
+		docker:      dockerCli,
+		send:        send,
+		maxSessions: maxSessions,
+		idleTimeout: idleTimeout,
+		sessions:    make(map[string]*session),
+	}
+}
+
+// Handle applies one frame from the cloud. It never blocks, so it is safe to
+// call from the WebSocket read loop.
+func (m *Manager) Handle(ctx context.Context, msg apiclient.ExecMessage) {
+	if msg.SessionId == "" {
+		log.Printf("Ignoring %s without a session_id", msg.Type)
+		return
+	}
+
+	switch msg.Type {
+	case "exec.open":
+		m.open(ctx, msg)
+	case "exec.stdin", "exec.resize":
+		s := m.get(msg.SessionId)
+		if s == nil {
+			return
+		}
+		select {
+		case s.input <- msg:
+		default:
+			s.close("input overflow")
+		}
+	case "exec.close":
+		if s := m.get(msg.SessionId); s != nil {
+			s.close("closed")
+		}
+	}
+}
+
+// CloseAll ends every session, e.g. when the cloud connection drops and no
+// one is left to read the output.
+func (m *Manager) CloseAll(reason string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, s := range m.sessions {
+		s.close(reason)
+	}
+}
+
+func (m *Manager) get(id string) *session {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.sessions[id]
+}
+
+func (m *Manager) open(ctx context.Context, msg apiclient.ExecMessage) {
+	if msg.ContainerId == "" || len(msg.Cmd) == 0 {
+		m.exit(msg.SessionId, nil, "error", fmt.Errorf("containerId and cmd are required"))
+		return
+	}
+
+	m.mu.Lock()
+	if _, exists := m.sessions[msg.SessionId]; exists {
+		m.mu.Unlock()
+		log.Printf("Ignoring exec.open for existing session %s", msg.SessionId)
+		return
+	}
+	if len(m.sessions) >= m.maxSessions {
+		m.mu.Unlock()
+		m.exit(msg.SessionId, nil, "error", fmt.Errorf("too many exec sessions (limit %d)", m.maxSessions))
+		return
+	}
+	sessionCtx, cancel := context.WithCancel(ctx)
+	s := &session{
+		id:     msg.SessionId,
+		tty:    msg.Tty,
+		input:  make(chan apiclient.ExecMessage, inputBuffer),
+		ctx:    sessionCtx,
+		cancel: cancel,
+	}
+	s.touch()
+	m.sessions[s.id] = s
+	m.mu.Unlock()
+
+	go m.run(s, msg)
+}
+
+func (m *Manager) run(s *session, open apiclient.ExecMessage) {
+	defer func() {
+		m.mu.Lock()
+		delete(m.sessions, s.id)
+		m.mu.Unlock()
+		s.cancel()
+	}()
+
+	if m.Authorize != nil {
+		containerId, err := m.Authorize(s.ctx, open.ContainerId)
+		if err != nil {
+			m.exit(s.id, nil, "denied", err)
+			return
+		}
+		open.ContainerId = containerId
+	}
+
+	execID, conn, err := m.docker.ExecAttach(s.ctx, open.ContainerId, docker.ExecOptions{
+		Cmd:        open.Cmd,
+		Tty:        open.Tty,
+		Env:        open.Env,
+		User:       open.User,
+		WorkingDir: open.WorkingDir,
+		Cols:       open.Cols,
+		Rows:       open.Rows,
+	})
+	if err != nil {
+		m.exit(s.id, nil, "error", err)
+		return
+	}
+	defer conn.Close()
+
+	log.Printf("Exec session %s started in container %s: %v", s.id, open.ContainerId, open.Cmd)
+	if err := m.send(apiclient.ExecMessage{Type: "exec.opened", SessionId: s.id}); err != nil {
+		s.close("disconnected")
+	}
+
+	outputDone := make(chan error, 1)
+	go func() {
+		outputDone <- m.pump(s, conn)
+	}()
+
+	idle := time.NewTicker(idleCheckInterval)
+	defer idle.Stop()
+
+	var outputErr error
+loop:
+	for {
+		select {
+		case outputErr = <-outputDone:
+			break loop
+		case <-s.ctx.Done():
+			// Closing the connection unblocks the output pump.
+			conn.Close()
+			<-outputDone
+			break loop
+		case in := <-s.input:
+			s.touch()
+			if err := m.apply(s, execID, conn, in); err != nil {
+				log.Printf("Exec session %s: %v", s.id, err)
+				s.close("error")
+			}
+		case <-idle.C:
+			if time.Since(time.Unix(0, s.lastActive.Load())) > m.idleTimeout {
+				s.close("idle timeout")
+			}
+		}
+	}
+
+	reason := s.closeReason()
+	if reason == "" {
+		reason = "exited"
+	}
+	if outputErr != nil && reason == "exited" {
+		reason = "error"
+	}
+
+	// The session context may be cancelled by now; the exit code lookup
+	// still needs to reach Docker.
+	var exitCode *int
+	if code, running, err := m.docker.ExecExitCode(context.Background(), execID); err == nil && !running {
+		exitCode = &code
+	}
+	m.exit(s.id, exitCode, reason, outputErr)
+	log.Printf("Exec session %s ended: %s", s.id, reason)
+}
+
+// apply forwards one stdin or resize frame to the exec process.
+func (m *Manager) apply(s *session, execID string, conn types.HijackedResponse, in apiclient.ExecMessage) error {
+	switch in.Type {
+	case "exec.stdin":
+		if len(in.Data) > 0 {
+			conn.Conn.SetWriteDeadline(time.Now().Add(stdinWriteTimeout))
+			if _, err := conn.Conn.Write(in.Data); err != nil {
+				return fmt.Errorf("failed to write stdin: %w", err)
+			}
+		}
+		if in.EOF {
+			if err := conn.CloseWrite(); err != nil {
+				return fmt.Errorf("failed to close stdin: %w", err)
+			}
+		}
+	case "exec.resize":
+		if s.tty && in.Cols > 0 && in.Rows > 0 {
+			if err := m.docker.ExecResize(s.ctx, execID, in.Cols, in.Rows); err != nil {
+				// A failed resize leaves the terminal usable.
+				log.Printf("Exec session %s: failed to resize: %v", s.id, err)
+			}
+		}
+	}
+	return nil
+}
+
+// pump forwards the process's output until it exits or the connection is
+// closed. A TTY has a single raw stream; otherwise stdout and stderr are
+// demultiplexed.
+func (m *Manager) pump(s *session, conn types.HijackedResponse) error {
+	stdout := &outputWriter{manager: m, session: s, stream: "stdout"}
+	if !s.tty {
+		stderr := &outputWriter{manager: m, session: s, stream: "stderr"}
+		_, err := stdcopy.StdCopy(stdout, stderr, conn.Reader)
+		return m.pumpError(s, err)
+	}
+
+	buf := make([]byte, outputChunkSize)
+	for {
+		n, err := conn.Reader.Read(buf)
+		if n > 0 {
+			if _, werr := stdout.Write(buf[:n]); werr != nil {
+				return werr
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return m.pumpError(s, err)
+		}
+	}
+}
+
+// pumpError hides the read error caused by closing the connection on
+// purpose.
+func (m *Manager) pumpError(s *session, err error) error {
+	if err == nil || s.ctx.Err() != nil {
+		return nil
+	}
+	return err
+}
+
+func (m *Manager) exit(sessionId string, exitCode *int, reason string, err error) {
+	msg := apiclient.ExecMessage{
+		Type:      "exec.exit",
+		SessionId: sessionId,
+		ExitCode:  exitCode,
+		Reason:    reason,
+	}
+	if err != nil {
+		msg.Error = err.Error()
+	}
+	if sendErr := m.send(msg); sendErr != nil {
+		log.Printf("Exec session %s: failed to report exit: %v", sessionId, sendErr)
+	}
+}
+
+func (s *session) touch() {
+	s.lastActive.Store(time.Now().UnixNano())
+}
+
+// close ends the session. Only the first reason is kept.
+func (s *session) close(reason string) {
+	s.mu.Lock()
+	if s.reason == "" {
+		s.reason = reason
+	}
+	s.mu.Unlock()
+	s.cancel()
+}
+
+func (s *session) closeReason() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.reason
+}
+
+type outputWriter struct {
+	manager *Manager
+	session *session
+	stream  string
+}
+
+func (w *outputWriter) Write(p []byte) (int, error) {
+	w.session.touch()
+	// The frame is marshalled later by the write loop, so it needs its own
+	// copy of the bytes.
+	data := make([]byte, len(p))
+	copy(data, p)
+	err := w.manager.send(apiclient.ExecMessage{
+		Type:      "exec.output",
+		SessionId: w.session.id,
+		Stream:    w.stream,
+		Data:      data,
+	})
+	if err != nil {
+		w.session.close("disconnected")
+		return 0, err
+	}
+	return len(p), nil
+}
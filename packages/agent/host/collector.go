@@ -0,0 +1,321 @@
+package host
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	apiclient "docker-dashboard-agent/client"
+)
+
+// Collector reads machine-level metrics from procfs. When the agent runs in
+// a container, ProcPath should point at the host's /proc mounted into it
+// (for example /host/proc) and RootPath at the host's / (for example /host),
+// so the Docker root directory resolves to the host filesystem.
+type Collector struct {
+	procPath   string
+	rootPath   string
+	dockerRoot string
+
+	mu      sync.Mutex
+	prevCPU *cpuTimes
+}
+
+type cpuTimes struct {
+	busy, total uint64
+}
+
+func NewCollector(procPath, rootPath, dockerRoot string) *Collector {
+	return &Collector{
+		procPath:   procPath,
+		rootPath:   rootPath,
+		dockerRoot: dockerRoot,
+	}
+}
+
+// Collect takes one sample. Sources that cannot be read are left out of the
+// result rather than failing the whole sample; an error is returned only
+// when nothing could be read.
+func (c *Collector) Collect() (*apiclient.HostMetrics, error) {
+	m := &apiclient.HostMetrics{
+		Timestamp: time.Now().UTC().Format(time.RFC3339Nano),
+	}
+
+	var failures []string
+	for _, read := range []struct {
+		name string
+		fn   func(*apiclient.HostMetrics) error
+	}{
+		{"loadavg", c.readLoadAvg},
+		{"meminfo", c.readMemInfo},
+		{"stat", c.readCPU},
+		{"diskstats", c.readDiskStats},
+		{"net/dev", c.readNetDev},
+		{"filesystem", c.readFilesystem},
+	} {
+		if err := read.fn(m); err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %v", read.name, err))
+		}
+	}
+
+	if len(failures) == 6 {
+		return nil, fmt.Errorf("failed to collect host metrics: %s", strings.Join(failures, "; "))
+	}
+	return m, nil
+}
+
+func (c *Collector) proc(name string) string {
+	return filepath.Join(c.procPath, name)
+}
+
+func (c *Collector) readLoadAvg(m *apiclient.HostMetrics) error {
+	data, err := os.ReadFile(c.proc("loadavg"))
+	if err != nil {
+		return err
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) < 3 {
+		return fmt.Errorf("unexpected format")
+	}
+	loads := make([]float64, 3)
+	for i := range loads {
+		if loads[i], err = strconv.ParseFloat(fields[i], 64); err != nil {
+			return err
+		}
+	}
+	m.Load1, m.Load5, m.Load15 = &loads[0], &loads[1], &loads[2]
+	return nil
+}
+
+func (c *Collector) readMemInfo(m *apiclient.HostMetrics) error {
+	f, err := os.Open(c.proc("meminfo"))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	values := make(map[string]int64)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// "MemTotal:        6147400 kB"
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		v, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		if len(fields) == 3 && fields[2] == "kB" {
+			v *= 1024
+		}
+		values[strings.TrimSuffix(fields[0], ":")] = v
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	total, ok := values["MemTotal"]
+	if !ok {
+		return fmt.Errorf("MemTotal missing")
+	}
+	available, ok := values["MemAvailable"]
+	if !ok {
+		// Kernels before 3.14 have no MemAvailable.
+		available = values["MemFree"] + values["Buffers"] + values["Cached"]
+	}
+	used := total - available
+	swapTotal := values["SwapTotal"]
+	swapFree := values["SwapFree"]
+
+	m.MemoryTotalBytes = &total
+	m.MemoryAvailableBytes = &available
+	m.MemoryUsedBytes = &used
+	m.SwapTotalBytes = &swapTotal
+	m.SwapFreeBytes = &swapFree
+	return nil
+}
+
+// readCPU reports utilisation since the previous sample, so the first
+// sample after startup has no CPU figure.
+func (c *Collector) readCPU(m *apiclient.HostMetrics) error {
+	f, err := os.Open(c.proc("stat"))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	if !scanner.Scan() {
+		return fmt.Errorf("empty file")
+	}
+	// "cpu  user nice system idle iowait irq softirq steal guest guest_nice"
+	fields := strings.Fields(scanner.Text())
+	if len(fields) < 5 || fields[0] != "cpu" {
+		return fmt.Errorf("unexpected format")
+	}
+
+	var current cpuTimes
+	for i, field := range fields[1:] {
+		// guest and guest_nice are already counted in user and nice.
+		if i >= 8 {
+			break
+		}
+		v, err := strconv.ParseUint(field, 10, 64)
+		if err != nil {
+			return err
+		}
+		current.total += v
+		// idle and iowait
+		if i != 3 && i != 4 {
+			current.busy += v
+		}
+	}
+
+	c.mu.Lock()
+	prev := c.prevCPU
+	c.prevCPU = &current
+	c.mu.Unlock()
+
+	if prev != nil && current.total > prev.total && current.busy >= prev.busy {
+		percent := float64(current.busy-prev.busy) / float64(current.total-prev.total) * 100.0
+		m.CpuUsagePercent = &percent
+	}
+	return nil
+}
+
+type diskDevice struct {
+	name                        string
+	readSectors, writtenSectors int64
+}
+
+// readDiskStats sums sectors over whole disks. Partitions, device-mapper,
+// loop and ram devices are skipped so no I/O is counted twice.
+func (c *Collector) readDiskStats(m *apiclient.HostMetrics) error {
+	f, err := os.Open(c.proc("diskstats"))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var devices []diskDevice
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// major minor name reads merged sectors_read ms writes merged sectors_written ...
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 10 {
+			continue
+		}
+		name := fields[2]
+		if strings.HasPrefix(name, "loop") || strings.HasPrefix(name, "ram") || strings.HasPrefix(name, "dm-") {
+			continue
+		}
+		readSectors, err1 := strconv.ParseInt(fields[5], 10, 64)
+		writtenSectors, err2 := strconv.ParseInt(fields[9], 10, 64)
+		if err1 != nil || err2 != nil {
+			continue
+		}
+		devices = append(devices, diskDevice{name, readSectors, writtenSectors})
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	var read, written int64
+	for _, d := range devices {
+		if isPartition(d.name, devices) {
+			continue
+		}
+		// diskstats sectors are always 512 bytes, whatever the device uses.
+		read += d.readSectors * 512
+		written += d.writtenSectors * 512
+	}
+	m.DiskReadBytes = &read
+	m.DiskWriteBytes = &written
+	return nil
+}
+
+// isPartition reports whether name is a partition of another listed device:
+// sda1 of sda, nvme0n1p2 of nvme0n1, mmcblk0p1 of mmcblk0.
+func isPartition(name string, devices []diskDevice) bool {
+	for _, d := range devices {
+		if d.name == name || !strings.HasPrefix(name, d.name) {
+			continue
+		}
+		suffix := strings.TrimPrefix(strings.TrimPrefix(name, d.name), "p")
+		if _, err := strconv.Atoi(suffix); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// readNetDev sums traffic over the machine's own interfaces. Loopback and
+// the bridges and veths Docker creates are skipped, as container traffic
+// crosses them as well as the physical interface. It reads PID 1's view
+// because /proc/net follows the reader's network namespace, which inside a
+// container would be the agent's own.
+func (c *Collector) readNetDev(m *apiclient.HostMetrics) error {
+	f, err := os.Open(c.proc("1/net/dev"))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var rx, tx int64
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// "  eth0: rx_bytes rx_packets ... (8 fields) tx_bytes ..."
+		iface, counters, found := strings.Cut(scanner.Text(), ":")
+		if !found {
+			continue
+		}
+		iface = strings.TrimSpace(iface)
+		fields := strings.Fields(counters)
+		if isVirtualInterface(iface) || len(fields) < 9 {
+			continue
+		}
+		ifaceRx, err1 := strconv.ParseInt(fields[0], 10, 64)
+		ifaceTx, err2 := strconv.ParseInt(fields[8], 10, 64)
+		if err1 != nil || err2 != nil {
+			continue
+		}
+		rx += ifaceRx
+		tx += ifaceTx
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	m.NetworkRxBytes = &rx
+	m.NetworkTxBytes = &tx
+	return nil
+}
+
+// isVirtualInterface matches the interfaces the Docker client leaves out of
+// the host's addresses.
+func isVirtualInterface(name string) bool {
+	return name == "lo" || name == "docker0" || strings.HasPrefix(name, "br-") || strings.HasPrefix(name, "veth")
+}
+
+func (c *Collector) readFilesystem(m *apiclient.HostMetrics) error {
+	if c.dockerRoot == "" {
+		return fmt.Errorf("docker root dir unknown")
+	}
+
+	total, free, err := statFilesystem(filepath.Join(c.rootPath, c.dockerRoot))
+	if err != nil {
+		return err
+	}
+	used := total - free
+	m.FilesystemPath = c.dockerRoot
+	m.FilesystemTotalBytes = &total
+	m.FilesystemFreeBytes = &free
+	m.FilesystemUsedBytes = &used
+	return nil
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package host
+
+import "errors"
+
+func statFilesystem(path string) (total, free int64, err error) {
+	return 0, 0, errors.New("filesystem usage is only supported on linux")
+}
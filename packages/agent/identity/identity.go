@@ -0,0 +1,82 @@
+package identity
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Identity is what the agent receives from enrollment and must keep across
+// restarts, since enrollment tokens can only be used once.
+type Identity struct {
+	HostId         string    `json:"hostId"`
+	AgentToken     string    `json:"agentToken"`
+	OrganizationId string    `json:"organizationId"`
+	EnrolledAt     time.Time `json:"enrolledAt"`
+}
+
+// Load reads the identity stored at path. It returns nil without an error
+// when the file does not exist yet.
+func Load(path string) (*Identity, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read identity file: %w", err)
+	}
+
+	var id Identity
+	if err := json.Unmarshal(data, &id); err != nil {
+		return nil, fmt.Errorf("failed to parse identity file %s: %w", path, err)
+	}
+	if id.HostId == "" || id.AgentToken == "" {
+		return nil, fmt.Errorf("identity file %s is missing hostId or agentToken", path)
+	}
+
+	return &id, nil
+}
+
+// Save writes id to path atomically with owner-only permissions, because
+// the file holds the agent's bearer token.
+func Save(path string, id *Identity) error {
+	data, err := json.MarshalIndent(id, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal identity: %w", err)
+	}
+
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return fmt.Errorf("failed to create identity directory: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(dir, ".agent-id-*")
+	if err != nil {
+		return fmt.Errorf("failed to create identity file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := tmp.Chmod(0o600); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to set identity file permissions: %w", err)
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write identity file: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to sync identity file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to close identity file: %w", err)
+	}
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to replace identity file: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,250 @@
+package inventory
+
+import (
+	"context"
+	"log"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	apiclient "docker-dashboard-agent/client"
+	"docker-dashboard-agent/docker"
+)
+
+// eventDebounce coalesces bursts of events (create+start, die+destroy) for
+// the same container into a single inspect.
+const eventDebounce = 250 * time.Millisecond
+
+// Change tells subscribers that a container's snapshot was updated or
+// removed.
+type Change struct {
+	ContainerId string
+	// Action is the Docker event that caused the change, or "reconcile".
+	Action  string
+	Removed bool
+}
+
+// Store keeps an in-memory model of the host's containers. It is kept
+// current from the Docker events stream, inspecting only containers that
+// changed, with a periodic full reconcile as a safety net for missed events.
+type Store struct {
+	docker            *docker.Client
+	reconcileInterval time.Duration
+
+	mu          sync.RWMutex
+	containers  map[string]apiclient.ContainerSnapshot
+	subscribers []chan Change
+
+	ready     chan struct{}
+	readyOnce sync.Once
+}
+
+func NewStore(dockerCli *docker.Client, reconcileInterval time.Duration) *Store {
+	return &Store{
+		docker:            dockerCli,
+		reconcileInterval: reconcileInterval,
+		containers:        make(map[string]apiclient.ContainerSnapshot),
+		ready:             make(chan struct{}),
+	}
+}
+
+// Ready is closed once the first full reconcile has completed.
+func (s *Store) Ready() <-chan struct{} {
+	return s.ready
+}
+
+// Subscribe returns a channel that receives every change. Slow subscribers
+// miss changes rather than blocking the store, so they should re-read
+// Snapshots on a timer as well.
+func (s *Store) Subscribe() <-chan Change {
+	ch := make(chan Change, 256)
+	s.mu.Lock()
+	s.subscribers = append(s.subscribers, ch)
+	s.mu.Unlock()
+	return ch
+}
+
+// Snapshots returns the current containers ordered by name.
+func (s *Store) Snapshots() []apiclient.ContainerSnapshot {
+	s.mu.RLock()
+	snapshots := make([]apiclient.ContainerSnapshot, 0, len(s.containers))
+	for _, snapshot := range s.containers {
+		snapshots = append(snapshots, snapshot)
+	}
+	s.mu.RUnlock()
+
+	sort.Slice(snapshots, func(i, j int) bool {
+		if snapshots[i].Name != snapshots[j].Name {
+			return snapshots[i].Name < snapshots[j].Name
+		}
+		return snapshots[i].DockerId < snapshots[j].DockerId
+	})
+	return snapshots
+}
+
+func (s *Store) Get(containerId string) (apiclient.ContainerSnapshot, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	snapshot, ok := s.containers[containerId]
+	return snapshot, ok
+}
+
+// Run subscribes to Docker events and keeps the store current until ctx is
+// cancelled. The events stream is opened before each full reconcile so no
+// change can slip between the two.
+func (s *Store) Run(ctx context.Context) {
+	for ctx.Err() == nil {
+		s.watch(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(5 * time.Second):
+		}
+	}
+}
+
+func (s *Store) watch(ctx context.Context) {
+	watchCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	messages, errs := s.docker.ContainerEvents(watchCtx)
+	s.reconcile(ctx)
+
+	reconcileTicker := time.NewTicker(s.reconcileInterval)
+	defer reconcileTicker.Stop()
+
+	pending := make(map[string]string)
+	debounce := time.NewTimer(eventDebounce)
+	debounce.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case err := <-errs:
+			if ctx.Err() == nil {
+				log.Printf("Docker events stream ended: %v", err)
+			}
+			return
+		case msg := <-messages:
+			if len(pending) == 0 {
+				debounce.Reset(eventDebounce)
+			}
+			pending[msg.Actor.ID] = string(msg.Action)
+		case <-debounce.C:
+			for id, action := range pending {
+				s.refresh(ctx, id, action)
+			}
+			pending = make(map[string]string)
+		case <-reconcileTicker.C:
+			s.reconcile(ctx)
+		}
+	}
+}
+
+// refresh re-inspects one container after an event.
+func (s *Store) refresh(ctx context.Context, containerId, action string) {
+	if action == "destroy" {
+		s.remove(containerId, action)
+		return
+	}
+
+	snapshot, err := s.docker.InspectContainer(ctx, containerId)
+	if err != nil {
+		log.Printf("Failed to refresh container %s after %s: %v", containerId, action, err)
+		return
+	}
+	if snapshot == nil {
+		s.remove(containerId, action)
+		return
+	}
+	s.put(*snapshot, action)
+}
+
+// reconcile replaces the model with a full listing, emitting changes only
+// for containers that actually differ.
+func (s *Store) reconcile(ctx context.Context) {
+	snapshots, err := s.docker.ListContainers(ctx)
+	if err != nil {
+		log.Printf("Failed to reconcile containers: %v", err)
+		return
+	}
+
+	seen := make(map[string]bool, len(snapshots))
+	for _, snapshot := range snapshots {
+		seen[snapshot.DockerId] = true
+		s.put(snapshot, "reconcile")
+	}
+
+	s.mu.RLock()
+	var gone []string
+	for id := range s.containers {
+		if !seen[id] {
+			gone = append(gone, id)
+		}
+	}
+	s.mu.RUnlock()
+	for _, id := range gone {
+		s.remove(id, "reconcile")
+	}
+
+	s.readyOnce.Do(func() { close(s.ready) })
+}
+
+// RefreshStatus brings the human-readable Status of every container up to
+// date. Docker words it relative to now ("Up 5 minutes"), so it goes stale
+// without any event being emitted. Subscribers are not notified since
+// nothing they act on changed.
+func (s *Store) RefreshStatus(ctx context.Context) {
+	statuses, err := s.docker.ContainerStatuses(ctx)
+	if err != nil {
+		log.Printf("Failed to refresh container status: %v", err)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, snapshot := range s.containers {
+		if status, ok := statuses[id]; ok && status != snapshot.Status {
+			snapshot.Status = status
+			s.containers[id] = snapshot
+		}
+	}
+}
+
+func (s *Store) put(snapshot apiclient.ContainerSnapshot, action string) {
+	s.mu.Lock()
+	previous, existed := s.containers[snapshot.DockerId]
+	if existed && reflect.DeepEqual(previous, snapshot) {
+		s.mu.Unlock()
+		return
+	}
+	s.containers[snapshot.DockerId] = snapshot
+	s.mu.Unlock()
+
+	s.notify(Change{ContainerId: snapshot.DockerId, Action: action})
+}
+
+func (s *Store) remove(containerId, action string) {
+	s.mu.Lock()
+	_, existed := s.containers[containerId]
+	delete(s.containers, containerId)
+	s.mu.Unlock()
+
+	if existed {
+		s.notify(Change{ContainerId: containerId, Action: action, Removed: true})
+	}
+}
+
+func (s *Store) notify(change Change) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, ch := range s.subscribers {
+		select {
+		case ch <- change:
+		default:
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package logs
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Cursor records how far a container's logs have been shipped.
+type Cursor struct {
+	// Timestamp is the Docker timestamp of the last shipped line.
+	Timestamp time.Time `json:"timestamp"`
+	// Shipped is how many lines carrying exactly Timestamp were shipped.
+	// Docker's since filter is inclusive, so a resumed stream repeats them.
+	Shipped int `json:"shipped"`
+	// Seq is the sequence number of the last shipped entry. Entries joined
+	// from several lines take one number.
+	Seq uint64 `json:"seq"`
+}
+
+// Advance returns the cursor after reading one more line stamped t.
+func (c Cursor) Advance(t time.Time) Cursor {
+	if t.Equal(c.Timestamp) {
+		c.Shipped++
+	} else {
+		c.Timestamp = t
+		c.Shipped = 1
+	}
+	return c
+}
+
+// Cursors keeps a Cursor per container ID and persists them to a file so
+// streams resume where they left off after the agent restarts. An empty path
+// keeps them in memory only.
+type Cursors struct {
+	path string
+
+	mu      sync.Mutex
+	cursors map[string]Cursor
+	dirty   bool
+}
+
+// LoadCursors reads the cursors stored at path. A missing file yields an
+// empty set.
+func LoadCursors(path string) (*Cursors, error) {
+	c := &Cursors{path: path, cursors: make(map[string]Cursor)}
+	if path == "" {
+		return c, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read log cursor file: %w", err)
+	}
+	if err := json.Unmarshal(data, &c.cursors); err != nil {
+		return nil, fmt.Errorf("failed to parse log cursor file %s: %w", path, err)
+	}
+	return c, nil
+}
+
+// Get returns the cursor for a container and whether it has one.
+func (c *Cursors) Get(containerId string) (Cursor, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cursor, ok := c.cursors[containerId]
+	return cursor, ok
+}
+
+// Set records that a container's logs were shipped up to cursor.
+func (c *Cursors) Set(containerId string, cursor Cursor) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cursors[containerId] = cursor
+	c.dirty = true
+}
+
+// Retain forgets the cursors of containers not in keep, i.e. ones that were
+// removed.
+func (c *Cursors) Retain(keep map[string]bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for id := range c.cursors {
+		if !keep[id] {
+			delete(c.cursors, id)
+			c.dirty = true
+		}
+	}
+}
+
+// Save writes the cursors to disk atomically if they changed since the last
+// save.
+func (c *Cursors) Save() error {
+	c.mu.Lock()
+	if c.path == "" || !c.dirty {
+		c.mu.Unlock()
+		return nil
+	}
+	data, err := json.Marshal(c.cursors)
+	c.dirty = false
+	c.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("failed to marshal log cursors: %w", err)
+	}
+
+	if err := writeFile(c.path, data); err != nil {
+		c.mu.Lock()
+		c.dirty = true
+		c.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+func writeFile(path string, data []byte) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return fmt.Errorf("failed to create log cursor directory: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(dir, ".log-cursors-*")
+	if err != nil {
+		return fmt.Errorf("failed to create log cursor file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write log cursor file: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to sync log cursor file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to close log cursor file: %w", err)
+	}
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to replace log cursor file: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,177 @@
+package logs
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	apiclient "docker-dashboard-agent/client"
+)
+
+// MultilineLabelPrefix introduces the labels that configure multiline
+// assembly for one container, e.g.
+// docker-dashboard.multiline.start="^\d{4}-\d{2}-\d{2}". Any label set
+// overrides the corresponding agent-wide setting.
+const MultilineLabelPrefix = "docker-dashboard.multiline."
+
+// MultilineOptions configures how consecutive lines are joined into one
+// entry. A line matching Continue, or not matching Start, is appended to the
+// entry before it; every other line begins a new entry. With neither pattern
+// set, lines are passed through unchanged.
+type MultilineOptions struct {
+	Start    string
+	Continue string
+	// An entry is cut once it holds MaxLines lines or MaxBytes bytes of
+	// message.
+	MaxLines int
+	MaxBytes int
+	// Timeout is how long an entry waits for another line before it is
+	// shipped as is.
+	Timeout time.Duration
+}
+
+// WithLabels returns o with the settings from a container's multiline
+// labels applied.
+func (o MultilineOptions) WithLabels(labels map[string]interface{}) (MultilineOptions, error) {
+	for key, value := range labels {
+		name, ok := strings.CutPrefix(key, MultilineLabelPrefix)
+		if !ok {
+			continue
+		}
+		text, _ := value.(string)
+		var err error
+		switch name {
+		case "start":
+			o.Start = text
+		case "continue":
+			o.Continue = text
+		case "max_lines":
+			o.MaxLines, err = strconv.Atoi(text)
+		case "max_bytes":
+			o.MaxBytes, err = strconv.Atoi(text)
+		case "timeout":
+			o.Timeout, err = time.ParseDuration(text)
+		default:
+			err = fmt.Errorf("unknown setting")
+		}
+		if err != nil {
+			return o, fmt.Errorf("label %s: %w", key, err)
+		}
+	}
+	return o, nil
+}
+
+// Entry is a log item waiting to be shipped, with the cursor to record once
+// it has been.
+type Entry struct {
+	Item   apiclient.LogItem
+	Cursor Cursor
+}
+
+// Assembler joins consecutive lines of the same stream into entries. Lines
+// leave in the order they arrived, so the cursor of a shipped entry never
+// skips past a line still being assembled. A nil Assembler passes every line
+// through.
+type Assembler struct {
+	start, cont *regexp.Regexp
+	maxLines    int
+	maxBytes    int
+	timeout     time.Duration
+
+	pending  *Entry
+	lines    int
+	lastLine time.Time
+}
+
+// NewAssembler returns an Assembler for opts, or nil when opts sets no
+// pattern.
+func NewAssembler(opts MultilineOptions) (*Assembler, error) {
+	if opts.Start == "" && opts.Continue == "" {
+		return nil, nil
+	}
+	if opts.MaxLines <= 0 || opts.MaxBytes <= 0 || opts.Timeout <= 0 {
+		return nil, fmt.Errorf("multiline max_lines, max_bytes and timeout must be greater than zero")
+	}
+
+	a := &Assembler{
+		maxLines: opts.MaxLines,
+		maxBytes: opts.MaxBytes,
+		timeout:  opts.Timeout,
+	}
+	var err error
+	if opts.Start != "" {
+		if a.start, err = regexp.Compile(opts.Start); err != nil {
+			return nil, fmt.Errorf("invalid multiline start pattern: %w", err)
+		}
+	}
+	if opts.Continue != "" {
+		if a.cont, err = regexp.Compile(opts.Continue); err != nil {
+			return nil, fmt.Errorf("invalid multiline continue pattern: %w", err)
+		}
+	}
+	return a, nil
+}
+
+// Add takes the next line and returns the entries it completed.
+func (a *Assembler) Add(e Entry, now time.Time) []Entry {
+	if a == nil {
+		return []Entry{e}
+	}
+
+	var done []Entry
+	if a.pending != nil {
+		if a.continues(e.Item) {
+			a.pending.Item.Message += "\n" + e.Item.Message
+			a.pending.Cursor = e.Cursor
+			a.lines++
+			a.lastLine = now
+			return nil
+		}
+		done = append(done, *a.pending)
+	}
+
+	a.pending = &e
+	a.lines = 1
+	a.lastLine = now
+	return done
+}
+
+func (a *Assembler) continues(item apiclient.LogItem) bool {
+	if item.Stream != a.pending.Item.Stream || a.lines >= a.maxLines ||
+		len(a.pending.Item.Message)+1+len(item.Message) > a.maxBytes {
+		return false
+	}
+	if a.cont != nil && a.cont.MatchString(item.Message) {
+		return true
+	}
+	return a.start != nil && !a.start.MatchString(item.Message)
+}
+
+// Expire returns the entry being assembled if no line has been added to it
+// for the timeout.
+func (a *Assembler) Expire(now time.Time) []Entry {
+	if a == nil || a.pending == nil || now.Sub(a.lastLine) < a.timeout {
+		return nil
+	}
+	return a.Flush()
+}
+
+// Flush returns the entry being assembled, if any.
+func (a *Assembler) Flush() []Entry {
+	if a == nil || a.pending == nil {
+		return nil
+	}
+	done := []Entry{*a.pending}
+	a.pending = nil
+	return done
+}
+
+// Pending reports whether an entry is being assembled, and when it expires.
+func (a *Assembler) Pending() (time.Time, bool) {
+	if a == nil || a.pending == nil {
+		return time.Time{}, false
+	}
+	return a.lastLine.Add(a.timeout), true
+}
@@ -0,0 +1,186 @@
+package logs
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	apiclient "docker-dashboard-agent/client"
+)
+
+func line(seq uint64, stream, message string) Entry {
+	return Entry{
+		Item:   apiclient.LogItem{Stream: stream, Message: message},
+		Cursor: Cursor{Seq: seq},
+	}
+}
+
+// assembled returns the message and cursor Seq of each entry.
+func assembled(entries []Entry) []string {
+	var out []string
+	for _, e := range entries {
+		out = append(out, fmt.Sprintf("%s:%s@%d", e.Item.Stream, e.Item.Message, e.Cursor.Seq))
+	}
+	return out
+}
+
+func TestAssembler(t *testing.T) {
+	defaults := MultilineOptions{MaxLines: 100, MaxBytes: 1 << 20, Timeout: time.Second}
+	withStart := defaults
+	withStart.Start = `^\d{4}-`
+	withContinue := defaults
+	withContinue.Continue = `^\s`
+
+	tests := []struct {
+		name  string
+		opts  MultilineOptions
+		lines []Entry
+		want  []string
+	}{
+		{
+			name: "start pattern joins a stack trace",
+			opts: withStart,
+			lines: []Entry{
+				line(1, "stderr", "2024-05-01 panic: boom"),
+				line(2, "stderr", "goroutine 1 [running]:"),
+				line(3, "stderr", "main.main()"),
+				line(4, "stderr", "2024-05-01 restarting"),
+			},
+			want: []string{"stderr:2024-05-01 panic: boom\ngoroutine 1 [running]:\nmain.main()@3", "stderr:2024-05-01 restarting@4"},
+		},
+		{
+			name: "continue pattern joins indented lines",
+			opts: withContinue,
+			lines: []Entry{
+				line(1, "stdout", "Traceback:"),
+				line(2, "stdout", "  File x.py"),
+				line(3, "stdout", "ValueError"),
+			},
+			want: []string{"stdout:Traceback:\n  File x.py@2", "stdout:ValueError@3"},
+		},
+		{
+			name: "a stream switch ends the entry",
+			opts: withStart,
+			lines: []Entry{
+				line(1, "stdout", "2024-05-01 request"),
+				line(2, "stderr", "warning"),
+				line(3, "stderr", "details"),
+				line(4, "stdout", "body"),
+			},
+			want: []string{"stdout:2024-05-01 request@1", "stderr:warning\ndetails@3", "stdout:body@4"},
+		},
+		{
+			name: "max lines cuts the entry",
+			opts: MultilineOptions{Start: `^\d{4}-`, MaxLines: 2, MaxBytes: 1 << 20, Timeout: time.Second},
+			lines: []Entry{
+				line(1, "stdout", "2024-05-01 a"),
+				line(2, "stdout", "b"),
+				line(3, "stdout", "c"),
+				line(4, "stdout", "d"),
+			},
+			want: []string{"stdout:2024-05-01 a\nb@2", "stdout:c\nd@4"},
+		},
+		{
+			name: "max bytes cuts the entry",
+			opts: MultilineOptions{Start: `^START`, MaxLines: 100, MaxBytes: 12, Timeout: time.Second},
+			lines: []Entry{
+				line(1, "stdout", "START"),
+				line(2, "stdout", "123456"),
+				line(3, "stdout", "7"),
+			},
+			// "START\n123456" is exactly 12 bytes; one more line would not fit.
+			want: []string{"stdout:START\n123456@2", "stdout:7@3"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, err := NewAssembler(tt.opts)
+			if err != nil {
+				t.Fatalf("NewAssembler: %v", err)
+			}
+			now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+			var got []Entry
+			for _, l := range tt.lines {
+				got = append(got, a.Add(l, now)...)
+			}
+			got = append(got, a.Flush()...)
+			if !reflect.DeepEqual(assembled(got), tt.want) {
+				t.Errorf("entries =\n%q\nwant\n%q", assembled(got), tt.want)
+			}
+		})
+	}
+}
+
+func TestAssemblerExpire(t *testing.T) {
+	a, err := NewAssembler(MultilineOptions{Start: `^\d{4}-`, MaxLines: 100, MaxBytes: 1 << 20, Timeout: time.Second})
+	if err != nil {
+		t.Fatalf("NewAssembler: %v", err)
+	}
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	a.Add(line(1, "stdout", "2024-05-01 panic"), start)
+	a.Add(line(2, "stdout", "trace"), start.Add(500*time.Millisecond))
+
+	// The timeout runs from the last line, not the first.
+	deadline, ok := a.Pending()
+	if want := start.Add(1500 * time.Millisecond); !ok || !deadline.Equal(want) {
+		t.Errorf("Pending = %s, %v, want %s", deadline, ok, want)
+	}
+	if got := a.Expire(start.Add(time.Second)); got != nil {
+		t.Errorf("Expire before the timeout returned %q", assembled(got))
+	}
+	got := a.Expire(start.Add(1500 * time.Millisecond))
+	if want := []string{"stdout:2024-05-01 panic\ntrace@2"}; !reflect.DeepEqual(assembled(got), want) {
+		t.Errorf("Expire = %q, want %q", assembled(got), want)
+	}
+	if _, ok := a.Pending(); ok {
+		t.Errorf("entry still pending after Expire")
+	}
+	if got := a.Expire(start.Add(time.Hour)); got != nil {
+		t.Errorf("second Expire returned %q", assembled(got))
+	}
+}
+
+func TestNilAssemblerPassesLinesThrough(t *testing.T) {
+	a, err := NewAssembler(MultilineOptions{})
+	if err != nil || a != nil {
+		t.Fatalf("NewAssembler without patterns = %v, %v", a, err)
+	}
+	now := time.Now()
+	got := a.Add(line(1, "stdout", "  indented"), now)
+	if want := []string{"stdout:  indented@1"}; !reflect.DeepEqual(assembled(got), want) {
+		t.Errorf("Add = %q, want %q", assembled(got), want)
+	}
+	if a.Flush() != nil || a.Expire(now) != nil {
+		t.Errorf("nil assembler held on to a line")
+	}
+}
+
+func TestMultilineOptionsWithLabels(t *testing.T) {
+	base := MultilineOptions{Start: "^agent", MaxLines: 10, MaxBytes: 100, Timeout: time.Second}
+	got, err := base.WithLabels(map[string]interface{}{
+		MultilineLabelPrefix + "continue":  `^\s`,
+		MultilineLabelPrefix + "max_lines": "50",
+		MultilineLabelPrefix + "timeout":   "250ms",
+		"other.label":                      "ignored",
+	})
+	if err != nil {
+		t.Fatalf("WithLabels: %v", err)
+	}
+	want := MultilineOptions{Start: "^agent", Continue: `^\s`, MaxLines: 50, MaxBytes: 100, Timeout: 250 * time.Millisecond}
+	if got != want {
+		t.Errorf("WithLabels = %+v, want %+v", got, want)
+	}
+
+	for _, labels := range []map[string]interface{}{
+		{MultilineLabelPrefix + "max_bytes": "lots"},
+		{MultilineLabelPrefix + "startt": "^x"},
+	} {
+		if _, err := base.WithLabels(labels); err == nil || !strings.Contains(err.Error(), MultilineLabelPrefix) {
+			t.Errorf("WithLabels(%v) error = %v", labels, err)
+		}
+	}
+}
@@ -0,0 +1,308 @@
+package logs
+
+import (
+	"encoding/json"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	apiclient "docker-dashboard-agent/client"
+)
+
+// ParseLabel turns structured parsing on or off for one container,
+// overriding the agent-wide setting.
+const ParseLabel = "docker-dashboard.logs.parse"
+
+// Normalized severities.
+const (
+	LevelTrace = "trace"
+	LevelDebug = "debug"
+	LevelInfo  = "info"
+	LevelWarn  = "warn"
+	LevelError = "error"
+	LevelFatal = "fatal"
+)
+
+var (
+	levelKeys = []string{"level", "lvl", "severity", "loglevel", "log.level"}
+	msgKeys   = []string{"msg", "message"}
+	timeKeys  = []string{"time", "ts", "timestamp", "@timestamp"}
+)
+
+// Level words as they appear in plain text, e.g. "ERROR" or "[warn]".
+// Lowercase words only count inside brackets so prose such as "no error
+// found" is not taken for a level.
+var plainLevel = regexp.MustCompile(`\b(TRACE|DEBUG|INFO|NOTICE|WARN|WARNING|ERROR|ERR|CRITICAL|CRIT|FATAL|PANIC|EMERG|ALERT)\b|\[(?i:(trace|debug|info|notice|warn|warning|error|err|critical|crit|fatal|panic|emerg|alert))\]`)
+
+// plainLevelScan limits how far into a plain-text line a level is looked
+// for; it is normally near the start.
+const plainLevelScan = 200
+
+// Parse extracts structure from item's message. A JSON object or logfmt
+// line has its level, message and time fields moved to Level, Message and
+// LoggedAt and the rest put in Fields. Any other line only gets a Level, and
+// only if it contains a common level word.
+func Parse(item *apiclient.LogItem) {
+	fields, ok := parseJSON(item.Message)
+	if !ok {
+		fields, ok = parseLogfmt(item.Message)
+	}
+	if !ok {
+		item.Level = plainTextLevel(item.Message)
+		return
+	}
+
+	if key, value, ok := take(fields, levelKeys); ok {
+		if level := NormalizeLevel(value); level != "" {
+			item.Level = level
+			delete(fields, key)
+		}
+	}
+	if key, value, ok := take(fields, msgKeys); ok {
+		if msg, isString := value.(string); isString {
+			item.Message = msg
+			delete(fields, key)
+		}
+	}
+	if key, value, ok := take(fields, timeKeys); ok {
+		if t, ok := parseTime(value); ok {
+			item.LoggedAt = t.UTC().Format(time.RFC3339Nano)
+			delete(fields, key)
+		}
+	}
+	if len(fields) > 0 {
+		item.Fields = fields
+	}
+}
+
+func take(fields map[string]interface{}, keys []string) (string, interface{}, bool) {
+	for _, key := range keys {
+		if value, ok := fields[key]; ok {
+			return key, value, true
+		}
+	}
+	return "", nil, false
+}
+
+func parseJSON(line string) (map[string]interface{}, bool) {
+	line = strings.TrimSpace(line)
+	if !strings.HasPrefix(line, "{") || !strings.HasSuffix(line, "}") {
+		return nil, false
+	}
+	decoder := json.NewDecoder(strings.NewReader(line))
+	// Keep large integers such as IDs exact.
+	decoder.UseNumber()
+	var fields map[string]interface{}
+	if err := decoder.Decode(&fields); err != nil || decoder.More() {
+		return nil, false
+	}
+	return fields, true
+}
+
+// parseLogfmt parses key=value pairs separated by spaces, with optionally
+// double-quoted values. To avoid mistaking prose for logfmt, every token must
+// be a pair and there must be at least two, or one naming a level or message.
+func parseLogfmt(line string) (map[string]interface{}, bool) {
+	fields := make(map[string]interface{})
+	rest := strings.TrimSpace(line)
+	for rest != "" {
+		eq := strings.IndexByte(rest, '=')
+		if eq <= 0 {
+			return nil, false
+		}
+		key := rest[:eq]
+		if !isLogfmtKey(key) {
+			return nil, false
+		}
+		rest = rest[eq+1:]
+
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			end := closingQuote(rest)
+			if end < 0 {
+				return nil, false
+			}
+			unquoted, err := strconv.Unquote(rest[:end+1])
+			if err != nil {
+				return nil, false
+			}
+			value = unquoted
+			rest = rest[end+1:]
+			if rest != "" && rest[0] != ' ' {
+				return nil, false
+			}
+		} else if sp := strings.IndexByte(rest, ' '); sp >= 0 {
+			value, rest = rest[:sp], rest[sp:]
+		} else {
+			value, rest = rest, ""
+		}
+		fields[key] = value
+		rest = strings.TrimLeft(rest, " ")
+	}
+
+	if len(fields) >= 2 {
+		return fields, true
+	}
+	if _, _, ok := take(fields, append(append([]string{}, levelKeys...), msgKeys...)); ok {
+		return fields, true
+	}
+	return nil, false
+}
+
+func isLogfmtKey(key string) bool {
+	for _, r := range key {
+		if r <= ' ' || r == '"' || r == '=' || unicode.IsSpace(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// closingQuote returns the index of the quote ending the string s starts
+// with, or -1.
+func closingQuote(s string) int {
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '"':
+			return i
+		}
+	}
+	return -1
+}
+
+// NormalizeLevel maps level names used by common logging libraries, and
+// pino/bunyan numeric levels, to one of the Level constants. It returns ""
+// for anything else.
+func NormalizeLevel(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return levelName(v)
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return numericLevel(n)
+		}
+		return levelName(v.String())
+	case float64:
+		return numericLevel(int64(v))
+	}
+	return ""
+}
+
+func levelName(name string) string {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "trace", "trc", "verbose":
+		return LevelTrace
+	case "debug", "dbg":
+		return LevelDebug
+	case "info", "inf", "information", "informational", "notice":
+		return LevelInfo
+	case "warn", "wrn", "warning":
+		return LevelWarn
+	case "error", "err", "eror":
+		return LevelError
+	case "fatal", "ftl", "critical", "crit", "panic", "emerg", "emergency", "alert", "dpanic":
+		return LevelFatal
+	}
+	if n, err := strconv.ParseInt(name, 10, 64); err == nil {
+		return numericLevel(n)
+	}
+	return ""
+}
+
+// numericLevel follows pino and bunyan: 10 trace, 20 debug, 30 info,
+// 40 warn, 50 error, 60 fatal.
+func numericLevel(n int64) string {
+	switch {
+	case n >= 60:
+		return LevelFatal
+	case n >= 50:
+		return LevelError
+	case n >= 40:
+		return LevelWarn
+	case n >= 30:
+		return LevelInfo
+	case n >= 20:
+		return LevelDebug
+	case n >= 10:
+		return LevelTrace
+	}
+	return ""
+}
+
+func plainTextLevel(message string) string {
+	if len(message) > plainLevelScan {
+		message = message[:plainLevelScan]
+	}
+	match := plainLevel.FindStringSubmatch(message)
+	if match == nil {
+		return ""
+	}
+	if match[1] != "" {
+		return levelName(match[1])
+	}
+	return levelName(match[2])
+}
+
+var timeLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02 15:04:05.999999999Z07:00",
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02 15:04:05,999",
+}
+
+// parseTime accepts the usual string layouts, read as UTC when they carry no
+// zone, and Unix times in seconds or milliseconds.
+func parseTime(value interface{}) (time.Time, bool) {
+	var number string
+	switch v := value.(type) {
+	case string:
+		for _, layout := range timeLayouts {
+			if t, err := time.Parse(layout, v); err == nil {
+				return t, true
+			}
+		}
+		number = v
+	case json.Number:
+		number = v.String()
+	default:
+		return time.Time{}, false
+	}
+
+	// Anything past the year 5138 in seconds is taken to be milliseconds.
+	const maxSeconds = 1e11
+	if n, err := strconv.ParseInt(number, 10, 64); err == nil {
+		switch {
+		case n <= 0:
+			return time.Time{}, false
+		case n > maxSeconds:
+			return time.UnixMilli(n), true
+		default:
+			return time.Unix(n, 0), true
+		}
+	}
+	seconds, err := strconv.ParseFloat(number, 64)
+	if err != nil || seconds <= 0 || math.IsInf(seconds, 0) || math.IsNaN(seconds) {
+		return time.Time{}, false
+	}
+	if seconds > maxSeconds {
+		seconds /= 1000
+	}
+	whole, frac := math.Modf(seconds)
+	return time.Unix(int64(whole), int64(frac*1e9)), true
+}
+
+// ParseEnabled reports whether structured parsing applies to a container
+// given the agent-wide setting and the container's labels.
+func ParseEnabled(enabled bool, labels map[string]interface{}) bool {
+	value, _ := labels[ParseLabel].(string)
+	if override, err := strconv.ParseBool(value); err == nil {
+		return override
+	}
+	return enabled
+}
@@ -0,0 +1,175 @@
+package logs
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	apiclient "docker-dashboard-agent/client"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name       string
+		message    string
+		wantMsg    string
+		wantLevel  string
+		wantTime   string
+		wantFields map[string]interface{}
+	}{
+		{
+			name:       "json with string level",
+			message:    `{"level":"WARNING","msg":"disk low","time":"2024-05-01T12:00:00+02:00","free":"5%"}`,
+			wantMsg:    "disk low",
+			wantLevel:  LevelWarn,
+			wantTime:   "2024-05-01T10:00:00Z",
+			wantFields: map[string]interface{}{"free": "5%"},
+		},
+		{
+			name:       "pino numeric level and epoch milliseconds",
+			message:    `{"level":50,"time":1714564800123,"pid":42,"msg":"request failed"}`,
+			wantMsg:    "request failed",
+			wantLevel:  LevelError,
+			wantTime:   "2024-05-01T12:00:00.123Z",
+			wantFields: map[string]interface{}{"pid": json.Number("42")},
+		},
+		{
+			name:      "epoch seconds with a fraction",
+			message:   `{"lvl":"dbg","ts":1714564800.5,"message":"tick"}`,
+			wantMsg:   "tick",
+			wantLevel: LevelDebug,
+			wantTime:  "2024-05-01T12:00:00.5Z",
+		},
+		{
+			name:      "epoch seconds as a string",
+			message:   `{"severity":"60","timestamp":"1714564800","msg":"dead"}`,
+			wantMsg:   "dead",
+			wantLevel: LevelFatal,
+			wantTime:  "2024-05-01T12:00:00Z",
+		},
+		{
+			name:       "unknown level and non-string message stay in fields",
+			message:    `{"level":"chatty","msg":{"a":1}}`,
+			wantMsg:    `{"level":"chatty","msg":{"a":1}}`,
+			wantFields: map[string]interface{}{"level": "chatty", "msg": map[string]interface{}{"a": json.Number("1")}},
+		},
+		{
+			name:       "logfmt",
+			message:    `time=2024-05-01T12:00:00Z level=info msg="listening on :8080" port=8080`,
+			wantMsg:    "listening on :8080",
+			wantLevel:  LevelInfo,
+			wantTime:   "2024-05-01T12:00:00Z",
+			wantFields: map[string]interface{}{"port": "8080"},
+		},
+		{
+			name:      "logfmt with a single level key",
+			message:   `level=error`,
+			wantMsg:   `level=error`,
+			wantLevel: LevelError,
+		},
+		{
+			name:    "prose with one pair is not logfmt",
+			message: `retrying with timeout=5s`,
+			wantMsg: `retrying with timeout=5s`,
+		},
+		{
+			name:    "prose with several pairs is not logfmt",
+			message: `set a=1 and b=2`,
+			wantMsg: `set a=1 and b=2`,
+		},
+		{
+			name:    "a lone unrelated pair is not logfmt",
+			message: `user=alice`,
+			wantMsg: `user=alice`,
+		},
+		{
+			name:    "unterminated quote is not logfmt",
+			message: `level=info msg="half`,
+			wantMsg: `level=info msg="half`,
+		},
+		{
+			name:      "plain text upper-case level",
+			message:   `2024/05/01 12:00:00 ERROR could not connect`,
+			wantMsg:   `2024/05/01 12:00:00 ERROR could not connect`,
+			wantLevel: LevelError,
+		},
+		{
+			name:      "plain text bracketed level",
+			message:   `[warn] slow query`,
+			wantMsg:   `[warn] slow query`,
+			wantLevel: LevelWarn,
+		},
+		{
+			name:    "plain text lower-case word is not a level",
+			message: `no error found`,
+			wantMsg: `no error found`,
+		},
+		{
+			name:    "truncated json is plain text",
+			message: `{"level":"info","msg":"cut`,
+			wantMsg: `{"level":"info","msg":"cut`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			item := apiclient.LogItem{Message: tt.message}
+			Parse(&item)
+			if item.Message != tt.wantMsg {
+				t.Errorf("Message = %q, want %q", item.Message, tt.wantMsg)
+			}
+			if item.Level != tt.wantLevel {
+				t.Errorf("Level = %q, want %q", item.Level, tt.wantLevel)
+			}
+			if item.LoggedAt != tt.wantTime {
+				t.Errorf("LoggedAt = %q, want %q", item.LoggedAt, tt.wantTime)
+			}
+			if !reflect.DeepEqual(item.Fields, tt.wantFields) {
+				t.Errorf("Fields = %#v, want %#v", item.Fields, tt.wantFields)
+			}
+		})
+	}
+}
+
+func TestNormalizeLevel(t *testing.T) {
+	tests := []struct {
+		value interface{}
+		want  string
+	}{
+		{"Information", LevelInfo},
+		{"notice", LevelInfo},
+		{"crit", LevelFatal},
+		{"eror", LevelError},
+		{json.Number("10"), LevelTrace},
+		{json.Number("35"), LevelInfo},
+		{json.Number("5"), ""},
+		{float64(40), LevelWarn},
+		{"40", LevelWarn},
+		{true, ""},
+		{"loud", ""},
+	}
+	for _, tt := range tests {
+		if got := NormalizeLevel(tt.value); got != tt.want {
+			t.Errorf("NormalizeLevel(%#v) = %q, want %q", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestParseEnabled(t *testing.T) {
+	tests := []struct {
+		enabled bool
+		labels  map[string]interface{}
+		want    bool
+	}{
+		{true, nil, true},
+		{false, nil, false},
+		{true, map[string]interface{}{ParseLabel: "false"}, false},
+		{false, map[string]interface{}{ParseLabel: "true"}, true},
+		{true, map[string]interface{}{ParseLabel: "maybe"}, true},
+	}
+	for _, tt := range tests {
+		if got := ParseEnabled(tt.enabled, tt.labels); got != tt.want {
+			t.Errorf("ParseEnabled(%v, %v) = %v, want %v", tt.enabled, tt.labels, got, tt.want)
+		}
+	}
+}
@@ -3,213 +3,612 @@ package main
 import (
 	"context"
 	"flag"
+	"fmt"
 	"log"
 	"os"
 	"os/signal"
 	"runtime"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
 
+	"docker-dashboard-agent/actions"
 	"docker-dashboard-agent/client"
+	"docker-dashboard-agent/compose"
+	"docker-dashboard-agent/config"
 	"docker-dashboard-agent/docker"
+	"docker-dashboard-agent/exec"
+	"docker-dashboard-agent/host"
+	"docker-dashboard-agent/identity"
+	"docker-dashboard-agent/inventory"
+	"docker-dashboard-agent/logs"
+	"docker-dashboard-agent/policy"
+	"docker-dashboard-agent/schedule"
+	"docker-dashboard-agent/signing"
+	"docker-dashboard-agent/spool"
+	"docker-dashboard-agent/stats"
+	"docker-dashboard-agent/supervisor"
 )
 
-func main() {
-	enrollPtr := flag.String("enroll", "", "Enrollment token to register this agent")
-	apiUrlPtr := flag.String("api-url", "http://localhost:3001", "Base URL of the Cloud API")
-	flag.Parse()
+// version is set at build time with -ldflags "-X main.version=...".
+var version = "dev"
 
-	apiURL := os.Getenv("AGENT_API_URL")
-	if apiURL == "" {
-		apiURL = *apiUrlPtr
+func main() {
+	cfg, err := loadConfig()
+	if err != nil {
+		log.Fatalf("Failed to load configuration: %v", err)
 	}
 
-	enrollToken := os.Getenv("AGENT_TOKEN")
-	if enrollToken == "" {
-		enrollToken = *enrollPtr
+	if cfg.LogLevel == "debug" {
+		log.SetFlags(log.LstdFlags | log.Lshortfile)
 	}
 
-	if enrollToken == "" {
-		log.Fatal("AGENT_TOKEN environment variable or --enroll flag is required for first run")
-	}
+	apiURL := cfg.API.URL
 
 	api := client.NewAPIClient(apiURL, "")
-	dockerCli, err := docker.NewClient()
+	api.HTTPClient.Timeout = cfg.API.Timeout
+	api.EnrollPath = cfg.API.EnrollPath
+	api.HeartbeatPath = cfg.API.HeartbeatPath
+	api.ContainersPath = cfg.API.ContainersPath
+	api.RetryAttempts = cfg.API.RetryAttempts
+	api.RetryDelay = cfg.API.RetryDelay
+
+	dockerCli, err := docker.NewClient(docker.Options{
+		Host:        cfg.Docker.Host,
+		APIVersion:  cfg.Docker.APIVersion,
+		Timeout:     cfg.Docker.Timeout,
+		StopTimeout: cfg.Containers.StopTimeout,
+		LogTail:     cfg.Logs.Tail,
+		LogMaxLine:  cfg.Logs.MaxLineBytes,
+	})
 	if err != nil {
 		log.Fatalf("Failed to initialize Docker client: %v", err)
 	}
 
-	ctx := context.Background()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 	info, err := dockerCli.GetInfo(ctx)
 	if err != nil {
 		log.Fatalf("Failed to get Docker info: %v", err)
 	}
 
-	hostname, _ := os.Hostname()
-
-	log.Printf("Enrolling agent with cloud at %s...", apiURL)
-	enrollResp, err := api.Enroll(client.EnrollRequest{
-		Token:         enrollToken,
-		Name:          hostname,
-		Hostname:      hostname,
-		OS:            runtime.GOOS,
-		Architecture:  runtime.GOARCH,
-		DockerVersion: info.ServerVersion,
-	})
-
+	ident, err := resolveIdentity(ctx, cfg, api, info.ServerVersion)
 	if err != nil {
-		log.Fatalf("Enrollment failed: %v", err)
+		log.Fatal(err)
 	}
 
-	log.Printf("Successfully enrolled. Host ID: %s", enrollResp.HostId)
-
 	// ====== Phase 3: Connect WebSocket ======
 	var wsClient *client.AgentWSClient
-	actionHandler := func(actionId, containerId, action string) {
-		log.Printf("Received action %s for container %s (ID: %s)", action, containerId, actionId)
-		var err error
-		switch action {
-		case "START":
-			err = dockerCli.StartContainer(ctx, containerId)
-		case "STOP":
-			err = dockerCli.StopContainer(ctx, containerId)
-		case "RESTART":
-			err = dockerCli.RestartContainer(ctx, containerId)
-		default:
-			err = fmt.Errorf("unknown action: %s", action)
+	store := inventory.NewStore(dockerCli, cfg.Containers.ReconcileInterval)
+	executor := actions.NewExecutor(dockerCli, cfg.Actions.DedupeTTL)
+	executor.Inventory = store.Snapshots
+	if cfg.Actions.PolicyFile != "" {
+		actionPolicy, err := policy.Load(cfg.Actions.PolicyFile)
+		if err != nil {
+			log.Fatalf("Failed to load action policy: %v", err)
+		}
+		executor.Policy = actionPolicy
+		log.Printf("Loaded action policy from %s (%d rules)", cfg.Actions.PolicyFile, len(actionPolicy.Rules))
+	}
+	if len(cfg.Actions.PublicKeys) > 0 {
+		verifier, err := signing.NewVerifier(cfg.Actions.PublicKeys, cfg.Actions.SignatureWindow)
+		if err != nil {
+			log.Fatalf("Failed to load action signing keys: %v", err)
+		}
+		executor.Verifier = verifier
+		log.Printf("Action signing enabled with %d trusted keys", len(cfg.Actions.PublicKeys))
+		if cfg.Exec.Enabled && !cfg.Exec.AllowUnsigned {
+			log.Printf("Exec sessions are not signed and will be refused; set exec.allow_unsigned: true to accept them")
+		}
+	}
+	actionHandler := func(req client.ActionRequest) {
+		log.Printf("Received action %s for container %s (ID: %s)", req.Action, req.ContainerId, req.ActionId)
+		result := executor.Handle(ctx, req)
+		if result.Duplicate {
+			log.Printf("Action %s was already handled; returning the previous result", req.ActionId)
+		} else if result.Status == actions.StatusSuccess {
+			log.Printf("Action succeeded")
+		} else {
+			log.Printf("Action failed: %s", result.Error)
 		}
 
 		if wsClient != nil {
+			wsClient.SendActionResult(result)
+		}
+	}
+	executor.OnProgress = func(progress client.ActionProgress) {
+		if wsClient != nil {
+			wsClient.SendActionProgress(progress)
+		}
+	}
+
+	wsClient = client.NewAgentWSClient(apiURL, ident.AgentToken, actionHandler)
+	wsClient.Path = cfg.API.WebSocketPath
+	wsClient.CancelHandler = func(req client.ActionRequest) {
+		if executor.Cancel(req) {
+			log.Printf("Cancelling action %s", req.ActionId)
+		} else {
+			log.Printf("Cancel for action %s had no effect", req.ActionId)
+		}
+	}
+	wsClient.MinBackoff = cfg.API.ReconnectMinDelay
+	wsClient.MaxBackoff = cfg.API.ReconnectMaxDelay
+	if cfg.Spool.Dir != "" {
+		outbox, err := spool.Open(cfg.Spool.Dir, cfg.Spool.MaxSizeMB<<20, cfg.Spool.SegmentSizeMB<<20)
+		if err != nil {
+			log.Fatalf("Failed to open spool: %v", err)
+		}
+		wsClient.Spool = outbox
+	}
+	var execManager *exec.Manager
+	if cfg.Exec.Enabled {
+		execManager = exec.NewManager(dockerCli, wsClient.SendExec, cfg.Exec.MaxSessions, cfg.Exec.IdleTimeout)
+		execManager.Authorize = func(ctx context.Context, containerId string) (string, error) {
+			if len(cfg.Actions.PublicKeys) > 0 && !cfg.Exec.AllowUnsigned {
+				return "", fmt.Errorf("exec sessions are refused while action signing is enabled")
+			}
+			decision, resolvedId, err := executor.Authorize(ctx, client.ActionRequest{Action: "EXEC", ContainerId: containerId})
 			if err != nil {
-				log.Printf("Action failed: %v", err)
-				wsClient.SendActionResult(actionId, "FAILURE", err.Error())
-			} else {
-				log.Printf("Action succeeded")
-				wsClient.SendActionResult(actionId, "SUCCESS", "")
+				return "", fmt.Errorf("failed to evaluate action policy: %w", err)
+			}
+			if !decision.Allowed {
+				log.Printf("Denied EXEC on container %s by policy rule %q", containerId, decision.Rule)
+				return "", fmt.Errorf("denied by policy rule %q", decision.Rule)
 			}
+			return resolvedId, nil
+		}
+		wsClient.ExecHandler = func(msg client.ExecMessage) {
+			execManager.Handle(ctx, msg)
 		}
 	}
-
-	wsClient = client.NewAgentWSClient(apiURL, enrollResp.AgentToken, actionHandler)
-	if err := wsClient.Connect(); err != nil {
-		log.Printf("Failed to connect to WebSocket: %v", err)
-		// Usually we'd retry, but for simulation we just log
-	} else {
-		log.Printf("Successfully connected to Cloud WS.")
+	wsClient.OnStateChange = func(state client.ConnState) {
+		if state != client.StateConnected && execManager != nil {
+			// Nobody is left to read the output.
+			execManager.CloseAll("disconnected")
+		}
+		if state == client.StateConnected {
+			log.Printf("Successfully connected to Cloud WS.")
+		} else if cfg.LogLevel == "debug" {
+			log.Printf("Cloud WS state: %s", state)
+		}
 	}
+	go wsClient.Run(ctx)
 
 	log.Printf("Starting agent loops...")
 
+	// The stop signal cancels ctx directly so requests blocked in the main
+	// loop, such as an inventory sync waiting to retry, give up at once.
 	stop := make(chan os.Signal, 1)
 	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-stop
+		log.Println("Agent shutting down...")
+		cancel()
+	}()
+
+	go heartbeatLoop(ctx, api, cfg.HeartbeatInterval)
+	syncTicker := time.NewTicker(cfg.Containers.SyncInterval)
+	statsTicker := time.NewTicker(cfg.Containers.PollInterval)
+
+	changes := store.Subscribe()
+	go store.Run(ctx)
+	select {
+	case <-store.Ready():
+	case <-time.After(cfg.Docker.Timeout):
+		log.Printf("Initial container inventory is not ready yet; continuing")
+	}
+
+	if cfg.Schedule.Enabled {
+		location := time.Local
+		if cfg.Schedule.Timezone != "" {
+			// Validate has already checked the name.
+			location, _ = time.LoadLocation(cfg.Schedule.Timezone)
+		}
+		scheduler := schedule.NewScheduler(store.Snapshots, func(ctx context.Context, containerId, action string) {
+			result := executor.RunLocal(ctx, client.ActionRequest{
+				Version:     client.ActionVersion,
+				ActionId:    fmt.Sprintf("schedule-%s-%s-%d", shortId(containerId), strings.ToLower(action), time.Now().Unix()),
+				Action:      action,
+				ContainerId: containerId,
+			}, "schedule")
+			if result.Status != actions.StatusSuccess {
+				log.Printf("Scheduled %s for container %s: %s %s", action, containerId, result.Status, result.Error)
+			}
+			wsClient.SendActionResult(result)
+		}, location)
+		go scheduler.Run(ctx)
+	}
+
+	if cfg.Containers.AutoRestart {
+		sup := supervisor.New(dockerCli, supervisor.Options{
+			Label:       cfg.Containers.ManagedLabel,
+			BackoffMin:  cfg.Containers.RestartBackoffMin,
+			BackoffMax:  cfg.Containers.RestartBackoffMax,
+			MaxAttempts: cfg.Containers.RestartMaxAttempts,
+			ResetAfter:  cfg.Containers.RestartResetAfter,
+		}, func(event client.SupervisorEvent) {
+			wsClient.SendSupervisorEvent(ident.HostId, event)
+		})
+		go sup.Run(ctx)
+		log.Printf("Supervising containers labelled %s", cfg.Containers.ManagedLabel)
+	}
 
-	heartbeatTicker := time.NewTicker(30 * time.Second)
-	syncTicker := time.NewTicker(10 * time.Second)
-	statsTicker := time.NewTicker(5 * time.Second)
+	syncer := client.NewInventorySyncer(api)
 
-	logStreams := make(map[string]context.CancelFunc)
+	logStreams := make(map[string]*logStream)
 	var logStreamsMu sync.Mutex
+	logCursors, err := logs.LoadCursors(cfg.Logs.CursorFile)
+	if err != nil {
+		log.Fatalf("Failed to load log cursors: %v", err)
+	}
+	collector := stats.NewCollector(dockerCli, cfg.Containers.StatsMaxAge)
+	hostCollector := host.NewCollector(cfg.Host.ProcPath, cfg.Host.RootPath, info.DockerRootDir)
+
+	manageStreams := func() {
+		logStreamsMu.Lock()
+		defer logStreamsMu.Unlock()
+
+		currentIds := make(map[string]bool)
+		knownIds := make(map[string]bool)
+		var running []string
+		for _, c := range store.Snapshots() {
+			knownIds[c.DockerId] = true
+			if c.State == "running" {
+				currentIds[c.DockerId] = true
+				running = append(running, c.DockerId)
+				if _, exists := logStreams[c.DockerId]; !exists {
+					streamCtx, cancel := context.WithCancel(context.Background())
+					stream := &logStream{cancel: cancel}
+					logStreams[c.DockerId] = stream
+					go func(containerId string, labels map[string]interface{}) {
+						streamLogsRoutine(streamCtx, containerId, labels, ident.HostId, wsClient, dockerCli, cfg.Logs, logCursors)
+						cancel()
+						// Docker ends the stream when the container stops, and
+						// a quick restart may never show it as not running.
+						// Forgetting the stream lets the next pass start a new
+						// one from the cursor.
+						logStreamsMu.Lock()
+						if logStreams[containerId] == stream {
+							delete(logStreams, containerId)
+						}
+						logStreamsMu.Unlock()
+					}(c.DockerId, c.Labels)
+				}
+			}
+		}
+		// Cancel stopped ones
+		for id, stream := range logStreams {
+			if !currentIds[id] {
+				stream.cancel()
+				delete(logStreams, id)
+			}
+		}
+		// Until the inventory is loaded every container would look removed.
+		select {
+		case <-store.Ready():
+			logCursors.Retain(knownIds)
+		default:
+		}
+
+		collector.Sync(ctx, running)
+	}
 
-	doSync(ctx, api, dockerCli)
+	doSync(ctx, syncer, store, dockerCli)
+	manageStreams()
 
 	for {
 		select {
-		case <-heartbeatTicker.C:
-			if err := api.Heartbeat(); err != nil {
-				log.Printf("Heartbeat failed: %v", err)
-			}
 		case <-syncTicker.C:
-			doSync(ctx, api, dockerCli)
-
-			// Manage log streams
-			containers, _ := dockerCli.ListContainers(ctx)
-			logStreamsMu.Lock()
-			currentIds := make(map[string]bool)
-			for _, c := range containers {
-				if c.State == "running" {
-					currentIds[c.DockerId] = true
-					if _, exists := logStreams[c.DockerId]; !exists {
-						streamCtx, cancel := context.WithCancel(context.Background())
-						logStreams[c.DockerId] = cancel
-						go streamLogsRoutine(streamCtx, c.DockerId, enrollResp.HostId, wsClient, dockerCli)
-					}
-				}
-			}
-			// Cancel stopped ones
-			for id, cancel := range logStreams {
-				if !currentIds[id] {
-					cancel()
-					delete(logStreams, id)
-				}
+			doSync(ctx, syncer, store, dockerCli)
+			manageStreams()
+			if err := logCursors.Save(); err != nil {
+				log.Printf("Failed to save log cursors: %v", err)
 			}
-			logStreamsMu.Unlock()
+
+		case <-changes:
+			manageStreams()
 
 		case <-statsTicker.C:
-			// Collect and send stats
-			containers, _ := dockerCli.ListContainers(ctx)
-			var metrics []client.MetricItem
-			for _, c := range containers {
-				if c.State == "running" {
-					statCtx, cancel := context.WithTimeout(ctx, 2*time.Second)
-					stats, err := dockerCli.GetContainerStats(statCtx, c.DockerId)
-					cancel()
-					if err == nil && stats != nil {
-						metrics = append(metrics, *stats)
-					}
-				}
+			if metrics := collector.Latest(); len(metrics) > 0 {
+				wsClient.SendMetrics(ident.HostId, metrics)
+			}
+			if hostMetrics, err := hostCollector.Collect(); err != nil {
+				log.Printf("Failed to collect host metrics: %v", err)
+			} else {
+				wsClient.SendHostMetrics(ident.HostId, *hostMetrics)
 			}
-			if len(metrics) > 0 && wsClient.Conn != nil {
-				wsClient.SendMetrics(enrollResp.HostId, metrics)
+
+		case <-ctx.Done():
+			if err := logCursors.Save(); err != nil {
+				log.Printf("Failed to save log cursors: %v", err)
 			}
+			return
+		}
+	}
+}
+
+// resolveIdentity reuses the credentials stored in agent.id_file when the
+// cloud still accepts them, and enrolls otherwise. Enrollment tokens are
+// single-use, so a fresh enrollment is only attempted when one was supplied.
+func resolveIdentity(ctx context.Context, cfg *config.Config, api *client.APIClient, dockerVersion string) (*identity.Identity, error) {
+	ident, err := identity.Load(cfg.Agent.IDFile)
+	if err != nil {
+		return nil, err
+	}
+
+	if ident != nil {
+		api.AgentToken = ident.AgentToken
+		err := api.Heartbeat(ctx)
+		switch {
+		case err == nil:
+			log.Printf("Reusing stored agent identity. Host ID: %s", ident.HostId)
+			return ident, nil
+		case !client.IsUnauthorized(err):
+			// The cloud may simply be down; the stored token is still our best bet.
+			log.Printf("Could not verify stored agent identity (%v); reusing it. Host ID: %s", err, ident.HostId)
+			return ident, nil
+		case cfg.EnrollToken == "":
+			return nil, fmt.Errorf("stored agent credentials were rejected and no enrollment token was supplied (set AGENT_TOKEN or --enroll)")
+		}
+		log.Printf("Stored agent credentials were rejected; re-enrolling")
+		api.AgentToken = ""
+	}
+
+	if cfg.EnrollToken == "" {
+		return nil, fmt.Errorf("AGENT_TOKEN environment variable or --enroll flag is required for first run")
+	}
+
+	hostname, _ := os.Hostname()
+	agentName := cfg.Agent.Name
+	if agentName == "" {
+		agentName = hostname
+	}
+
+	log.Printf("Enrolling agent with cloud at %s...", cfg.API.URL)
+	enrollResp, err := api.Enroll(ctx, client.EnrollRequest{
+		Token:         cfg.EnrollToken,
+		Name:          agentName,
+		Hostname:      hostname,
+		OS:            runtime.GOOS,
+		Architecture:  runtime.GOARCH,
+		DockerVersion: dockerVersion,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("enrollment failed: %w", err)
+	}
+
+	ident = &identity.Identity{
+		HostId:         enrollResp.HostId,
+		AgentToken:     enrollResp.AgentToken,
+		OrganizationId: enrollResp.OrganizationId,
+		EnrolledAt:     time.Now().UTC(),
+	}
+	if err := identity.Save(cfg.Agent.IDFile, ident); err != nil {
+		// Keep running; the next restart will need a new enrollment token.
+		log.Printf("Failed to persist agent identity: %v", err)
+	}
+
+	log.Printf("Successfully enrolled. Host ID: %s", ident.HostId)
+	return ident, nil
+}
+
+// loadConfig layers configuration sources in increasing precedence:
+// built-in defaults, the YAML file, environment variables, then flags.
+func loadConfig() (*config.Config, error) {
+	configPath := flag.String("config", "", "Path to the agent YAML config file (env AGENT_CONFIG)")
+	enrollPtr := flag.String("enroll", "", "Enrollment token to register this agent")
+	apiUrlPtr := flag.String("api-url", "", "Base URL of the Cloud API")
+	namePtr := flag.String("name", "", "Agent name reported at enrollment (defaults to the hostname)")
+	logLevelPtr := flag.String("log-level", "", "Log level: debug or info")
+	flag.Parse()
+
+	cfg := config.Default()
+
+	path := *configPath
+	if path == "" {
+		path = os.Getenv("AGENT_CONFIG")
+	}
+	if path != "" {
+		if err := config.LoadFile(cfg, path); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := config.ApplyEnv(cfg, os.Getenv); err != nil {
+		return nil, err
+	}
+
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "enroll":
+			cfg.EnrollToken = *enrollPtr
+		case "api-url":
+			cfg.API.URL = *apiUrlPtr
+		case "name":
+			cfg.Agent.Name = *namePtr
+		case "log-level":
+			cfg.LogLevel = *logLevelPtr
+		}
+	})
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
 
-		case <-stop:
-			log.Println("Agent shutting down...")
-			os.Exit(0)
+func shortId(id string) string {
+	if len(id) > 12 {
+		return id[:12]
+	}
+	return id
+}
+
+// heartbeatLoop sends a heartbeat every interval until ctx is cancelled. It
+// runs apart from the main loop so a slow or retrying heartbeat delays
+// nothing else.
+func heartbeatLoop(ctx context.Context, api *client.APIClient, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := api.Heartbeat(ctx); err != nil && ctx.Err() == nil {
+				log.Printf("Heartbeat failed: %v", err)
+			}
 		}
 	}
 }
 
-func doSync(ctx context.Context, api *client.APIClient, dockerCli *docker.Client) {
-	containers, err := dockerCli.ListContainers(ctx)
+func doSync(ctx context.Context, syncer *client.InventorySyncer, store *inventory.Store, dockerCli *docker.Client) {
+	hostSnapshot, err := dockerCli.GetHostSnapshot(ctx)
 	if err != nil {
-		log.Printf("Failed to list containers: %v", err)
-		return
+		log.Printf("Failed to get host snapshot: %v", err)
+	} else {
+		hostSnapshot.AgentVersion = version
+	}
+
+	store.RefreshStatus(ctx)
+	containers := store.Snapshots()
+	if err := syncer.Sync(ctx, containers, compose.Projects(containers), hostSnapshot); err != nil {
+		log.Printf("Failed to sync containers: %v", err)
 	}
-	_ = api.SyncContainers(containers)
 }
 
-func streamLogsRoutine(ctx context.Context, containerId string, hostId string, ws *client.AgentWSClient, dockerCli *docker.Client) {
+// logStream is a running streamLogsRoutine. Streams are compared by pointer
+// so a finished routine only forgets its own entry.
+type logStream struct {
+	cancel context.CancelFunc
+}
+
+// streamLogsRoutine ships a container's logs from where its cursor left off.
+// The cursor only advances once a batch has been handed to the WebSocket
+// client, so lines still batched or being joined when the stream stops are
+// read again.
+func streamLogsRoutine(ctx context.Context, containerId string, labels map[string]interface{}, hostId string, ws *client.AgentWSClient, dockerCli *docker.Client, logsCfg config.LogsConfig, cursors *logs.Cursors) {
+	multiline, err := logs.MultilineOptions{
+		Start:    logsCfg.Multiline.Start,
+		Continue: logsCfg.Multiline.Continue,
+		MaxLines: logsCfg.Multiline.MaxLines,
+		MaxBytes: logsCfg.Multiline.MaxBytes,
+		Timeout:  logsCfg.Multiline.Timeout,
+	}.WithLabels(labels)
+	var assembler *logs.Assembler
+	if err == nil {
+		assembler, err = logs.NewAssembler(multiline)
+	}
+	if err != nil {
+		log.Printf("Not joining multiline logs for container %s: %v", containerId, err)
+	}
+	parse := logs.ParseEnabled(logsCfg.Parse, labels)
+
 	logChan := make(chan client.LogItem, 100)
 	errChan := make(chan error, 1)
 
+	resume, seen := cursors.Get(containerId)
+	var since time.Time
+	if seen {
+		since = resume.Timestamp
+	}
 	go func() {
-		errChan <- dockerCli.StreamContainerLogs(ctx, containerId, logChan)
+		errChan <- dockerCli.StreamContainerLogs(ctx, containerId, since, logChan)
 	}()
 
+	// position is where the lines read so far end. Lines stamped
+	// resume.Timestamp that were shipped before come back because since is
+	// inclusive.
+	position := resume
+	repeated := 0
+
 	var batch []client.LogItem
-	ticker := time.NewTicker(1 * time.Second)
+	shipped := resume
+	seq := resume.Seq
+	flush := func() {
+		ws.SendLogs(hostId, batch)
+		cursors.Set(containerId, shipped)
+		batch = nil
+	}
+	queue := func(entries []logs.Entry) {
+		for _, entry := range entries {
+			if parse {
+				logs.Parse(&entry.Item)
+			}
+			seq++
+			shipped = entry.Cursor
+			shipped.Seq = seq
+			entry.Item.Seq = seq
+			batch = append(batch, entry.Item)
+			if len(batch) >= logsCfg.BatchSize {
+				flush()
+			}
+		}
+	}
+	read := func(item client.LogItem) {
+		timestamp, err := time.Parse(time.RFC3339Nano, item.Timestamp)
+		if err != nil {
+			timestamp = time.Now()
+		}
+		if seen {
+			if timestamp.Before(resume.Timestamp) {
+				return
+			}
+			if timestamp.Equal(resume.Timestamp) && repeated < resume.Shipped {
+				repeated++
+				return
+			}
+		}
+		position = position.Advance(timestamp)
+		queue(assembler.Add(logs.Entry{Item: item, Cursor: position}, time.Now()))
+	}
+
+	ticker := time.NewTicker(logsCfg.FlushInterval)
 	defer ticker.Stop()
+	expiry := time.NewTimer(time.Hour)
+	expiry.Stop()
+	defer expiry.Stop()
 
 	for {
 		select {
 		case <-ctx.Done():
 			return
 		case err := <-errChan:
+			// The stream has ended, e.g. because the container stopped; ship
+			// what it delivered.
+			for drained := false; !drained; {
+				select {
+				case item := <-logChan:
+					read(item)
+				default:
+					drained = true
+				}
+			}
+			queue(assembler.Flush())
+			if len(batch) > 0 {
+				flush()
+			}
 			if err != nil {
 				log.Printf("Stream error for container %s: %v", containerId, err)
 			}
 			return
 		case item := <-logChan:
-			batch = append(batch, item)
-			if len(batch) >= 50 {
-				ws.SendLogs(hostId, batch)
-				batch = nil
+			read(item)
+			if deadline, ok := assembler.Pending(); ok {
+				if !expiry.Stop() {
+					select {
+					case <-expiry.C:
+					default:
+					}
+				}
+				expiry.Reset(time.Until(deadline))
 			}
+		case <-expiry.C:
+			queue(assembler.Expire(time.Now()))
 		case <-ticker.C:
 			if len(batch) > 0 {
-				ws.SendLogs(hostId, batch)
-				batch = nil
+				flush()
 			}
 		}
 	}
@@ -0,0 +1,190 @@
+package policy
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ProtectedLabel marks a container that no remote action may touch,
+// whatever the policy file says.
+const ProtectedLabel = "docker-dashboard.protected"
+
+// protectedRule is the name reported when ProtectedLabel denies an action.
+const protectedRule = "builtin:protected-label"
+
+// UnknownContainerRule is the name reported when an action names a container
+// that does not exist, so no rule could be checked against it.
+const UnknownContainerRule = "builtin:unknown-container"
+
+// Policy decides which remote actions the agent will execute. Rules are
+// checked in file order and the first match wins; when none matches,
+// Default applies. A nil *Policy allows everything except containers
+// carrying ProtectedLabel.
+type Policy struct {
+	Default string `yaml:"default"`
+	Rules   []Rule `yaml:"rules"`
+}
+
+// Rule matches an action when every criterion it sets matches. Names and
+// images are globs where * matches any run of characters, including "/" and
+// ":". A label value of "" or "*" only requires the label to be present.
+// An action listed without the PROJECT_ prefix also covers its project
+// form, so a rule for STOP applies to every container PROJECT_STOP stops.
+type Rule struct {
+	Name    string            `yaml:"name"`
+	Effect  string            `yaml:"effect"`
+	Actions []string          `yaml:"actions"`
+	Names   []string          `yaml:"names"`
+	Images  []string          `yaml:"images"`
+	Labels  map[string]string `yaml:"labels"`
+
+	names  []*regexp.Regexp
+	images []*regexp.Regexp
+	labels map[string]*regexp.Regexp
+}
+
+const projectPrefix = "PROJECT_"
+
+// Target is the container an action would affect.
+type Target struct {
+	Name   string
+	Image  string
+	Labels map[string]string
+}
+
+// Decision is the outcome of Evaluate. Rule names the rule that decided it,
+// or "default" when no rule matched.
+type Decision struct {
+	Allowed bool
+	Rule    string
+}
+
+const (
+	EffectAllow = "allow"
+	EffectDeny  = "deny"
+)
+
+// Load reads and compiles the policy file at path.
+func Load(path string) (*Policy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read policy file: %w", err)
+	}
+
+	var p Policy
+	if err := yaml.Unmarshal(data, &p); err != nil {
+		return nil, fmt.Errorf("failed to parse policy file %s: %w", path, err)
+	}
+	if err := p.compile(); err != nil {
+		return nil, fmt.Errorf("invalid policy file %s: %w", path, err)
+	}
+	return &p, nil
+}
+
+func (p *Policy) compile() error {
+	p.Default = strings.ToLower(p.Default)
+	switch p.Default {
+	case "":
+		p.Default = EffectAllow
+	case EffectAllow, EffectDeny:
+	default:
+		return fmt.Errorf("default must be allow or deny")
+	}
+
+	for i := range p.Rules {
+		r := &p.Rules[i]
+		if r.Name == "" {
+			r.Name = fmt.Sprintf("rule %d", i+1)
+		}
+		r.Effect = strings.ToLower(r.Effect)
+		if r.Effect != EffectAllow && r.Effect != EffectDeny {
+			return fmt.Errorf("%s: effect must be allow or deny", r.Name)
+		}
+		for j, action := range r.Actions {
+			r.Actions[j] = strings.ToUpper(action)
+		}
+		r.names = compileGlobs(r.Names)
+		r.images = compileGlobs(r.Images)
+		r.labels = make(map[string]*regexp.Regexp, len(r.Labels))
+		for key, value := range r.Labels {
+			if value == "" {
+				value = "*"
+			}
+			r.labels[key] = compileGlob(value)
+		}
+	}
+	return nil
+}
+
+// Evaluate decides whether action may run against target.
+func (p *Policy) Evaluate(action string, target Target) Decision {
+	if strings.EqualFold(target.Labels[ProtectedLabel], "true") {
+		return Decision{Allowed: false, Rule: protectedRule}
+	}
+	if p == nil {
+		return Decision{Allowed: true, Rule: "default"}
+	}
+
+	for _, r := range p.Rules {
+		if r.matches(action, target) {
+			return Decision{Allowed: r.Effect == EffectAllow, Rule: r.Name}
+		}
+	}
+	return Decision{Allowed: p.Default == EffectAllow, Rule: "default"}
+}
+
+func (r *Rule) matches(action string, target Target) bool {
+	if len(r.Actions) > 0 && !contains(r.Actions, action) && !contains(r.Actions, strings.TrimPrefix(action, projectPrefix)) {
+		return false
+	}
+	if len(r.names) > 0 && !matchAny(r.names, target.Name) {
+		return false
+	}
+	if len(r.images) > 0 && !matchAny(r.images, target.Image) {
+		return false
+	}
+	for key, value := range r.labels {
+		actual, ok := target.Labels[key]
+		if !ok || !value.MatchString(actual) {
+			return false
+		}
+	}
+	return true
+}
+
+func compileGlobs(patterns []string) []*regexp.Regexp {
+	compiled := make([]*regexp.Regexp, len(patterns))
+	for i, pattern := range patterns {
+		compiled[i] = compileGlob(pattern)
+	}
+	return compiled
+}
+
+func compileGlob(pattern string) *regexp.Regexp {
+	quoted := regexp.QuoteMeta(pattern)
+	quoted = strings.ReplaceAll(quoted, `\*`, ".*")
+	quoted = strings.ReplaceAll(quoted, `\?`, ".")
+	return regexp.MustCompile("^" + quoted + "$")
+}
+
+func matchAny(patterns []*regexp.Regexp, value string) bool {
+	for _, pattern := range patterns {
+		if pattern.MatchString(value) {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
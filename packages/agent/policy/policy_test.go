@@ -0,0 +1,206 @@
+package policy
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func loadPolicy(t *testing.T, text string) *Policy {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "policy.yaml")
+	if err := os.WriteFile(path, []byte(text), 0o600); err != nil {
+		t.Fatalf("write policy: %v", err)
+	}
+	p, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	return p
+}
+
+func TestCompileGlob(t *testing.T) {
+	tests := []struct {
+		pattern string
+		value   string
+		want    bool
+	}{
+		{"web", "web", true},
+		{"web", "web-1", false},
+		{"web-*", "web-1", true},
+		{"web-*", "web-", true},
+		{"web-?", "web-12", false},
+		{"web-?", "web-1", true},
+		// * crosses the separators of image references.
+		{"ghcr.io/*", "ghcr.io/acme/api:1.2", true},
+		{"*:latest", "library/nginx:latest", true},
+		{"*:latest", "nginx:1.25", false},
+		// Regexp metacharacters are literal.
+		{"app.v1", "appXv1", false},
+		{"app(1)", "app(1)", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.pattern+" "+tt.value, func(t *testing.T) {
+			if got := compileGlob(tt.pattern).MatchString(tt.value); got != tt.want {
+				t.Errorf("glob %q matching %q = %v, want %v", tt.pattern, tt.value, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEvaluate(t *testing.T) {
+	p := loadPolicy(t, `
+default: deny
+rules:
+  - name: protect-db
+    effect: deny
+    actions: [stop, remove, kill]
+    labels:
+      tier: db
+  - name: ops-images
+    effect: allow
+    images: ["ghcr.io/acme/*"]
+  - name: web-restarts
+    effect: allow
+    actions: [restart]
+    names: ["web-*"]
+  - name: labelled
+    effect: allow
+    labels:
+      team: ""
+`)
+
+	tests := []struct {
+		name     string
+		action   string
+		target   Target
+		want     bool
+		wantRule string
+	}{
+		{
+			name:     "first matching rule wins over a later allow",
+			action:   "REMOVE",
+			target:   Target{Name: "db", Image: "ghcr.io/acme/postgres:16", Labels: map[string]string{"tier": "db"}},
+			want:     false,
+			wantRule: "protect-db",
+		},
+		{
+			name:     "deny rule does not apply to other actions",
+			action:   "RESTART",
+			target:   Target{Name: "db", Image: "ghcr.io/acme/postgres:16", Labels: map[string]string{"tier": "db"}},
+			want:     true,
+			wantRule: "ops-images",
+		},
+		{
+			name:     "name glob",
+			action:   "RESTART",
+			target:   Target{Name: "web-2", Image: "nginx:1.25"},
+			want:     true,
+			wantRule: "web-restarts",
+		},
+		{
+			name:     "name glob with another action",
+			action:   "STOP",
+			target:   Target{Name: "web-2", Image: "nginx:1.25"},
+			want:     false,
+			wantRule: "default",
+		},
+		{
+			name:     "empty label value only requires presence",
+			action:   "STOP",
+			target:   Target{Name: "worker", Image: "worker:1", Labels: map[string]string{"team": "payments"}},
+			want:     true,
+			wantRule: "labelled",
+		},
+		{
+			name:     "no rule matches",
+			action:   "STOP",
+			target:   Target{Name: "worker", Image: "worker:1"},
+			want:     false,
+			wantRule: "default",
+		},
+		{
+			name:     "container rule covers the project action",
+			action:   "PROJECT_STOP",
+			target:   Target{Name: "db", Image: "postgres:16", Labels: map[string]string{"tier": "db"}},
+			want:     false,
+			wantRule: "protect-db",
+		},
+		{
+			name:     "project container restarted by name glob",
+			action:   "PROJECT_RESTART",
+			target:   Target{Name: "web-2", Image: "nginx:1.25"},
+			want:     true,
+			wantRule: "web-restarts",
+		},
+		{
+			name:     "protected label beats any allow",
+			action:   "RESTART",
+			target:   Target{Name: "web-1", Image: "ghcr.io/acme/web:2", Labels: map[string]string{ProtectedLabel: "TRUE"}},
+			want:     false,
+			wantRule: protectedRule,
+		},
+		{
+			name:     "protected label set to false",
+			action:   "RESTART",
+			target:   Target{Name: "web-1", Image: "nginx:1.25", Labels: map[string]string{ProtectedLabel: "false"}},
+			want:     true,
+			wantRule: "web-restarts",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := p.Evaluate(tt.action, tt.target)
+			if got.Allowed != tt.want || got.Rule != tt.wantRule {
+				t.Errorf("Evaluate(%s) = %+v, want allowed=%v rule=%q", tt.action, got, tt.want, tt.wantRule)
+			}
+		})
+	}
+}
+
+func TestEvaluateExamplePolicyProjectActions(t *testing.T) {
+	p, err := Load(filepath.Join("..", "config", "policy.example.yaml"))
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	db := Target{Name: "shop-db-1", Image: "postgres:16"}
+	for _, action := range []string{"STOP", "PROJECT_STOP", "PROJECT_RESTART"} {
+		if got := p.Evaluate(action, db); got.Allowed || got.Rule != "protect-databases" {
+			t.Errorf("Evaluate(%s) on postgres = %+v, want denied by protect-databases", action, got)
+		}
+	}
+	if got := p.Evaluate("PROJECT_START", db); !got.Allowed {
+		t.Errorf("Evaluate(PROJECT_START) on postgres = %+v, want allowed", got)
+	}
+}
+
+func TestEvaluateNilPolicy(t *testing.T) {
+	var p *Policy
+	if got := p.Evaluate("REMOVE", Target{Name: "web"}); !got.Allowed {
+		t.Errorf("nil policy denied an unprotected container: %+v", got)
+	}
+	protected := Target{Name: "web", Labels: map[string]string{ProtectedLabel: "true"}}
+	if got := p.Evaluate("START", protected); got.Allowed || got.Rule != protectedRule {
+		t.Errorf("nil policy on a protected container = %+v", got)
+	}
+}
+
+func TestLoadRejectsInvalidEffects(t *testing.T) {
+	tests := map[string]string{
+		"bad default": "default: maybe\n",
+		"bad effect":  "rules:\n  - effect: permit\n",
+	}
+	for name, text := range tests {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "policy.yaml")
+			if err := os.WriteFile(path, []byte(text), 0o600); err != nil {
+				t.Fatalf("write policy: %v", err)
+			}
+			if _, err := Load(path); err == nil {
+				t.Errorf("Load accepted %q", text)
+			}
+		})
+	}
+}
@@ -0,0 +1,92 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCronRejectsInvalid(t *testing.T) {
+	tests := []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"5-1 * * * *",
+		"*/0 * * * *",
+		"*/x * * * *",
+		"* * * foo *",
+		"@every 5m",
+	}
+	for _, spec := range tests {
+		t.Run(spec, func(t *testing.T) {
+			if _, err := ParseCron(spec); err == nil {
+				t.Errorf("ParseCron(%q) succeeded", spec)
+			}
+		})
+	}
+}
+
+func TestCronMatches(t *testing.T) {
+	// 2024-05-01 is a Wednesday.
+	at := func(month time.Month, day, hour, minute int) time.Time {
+		return time.Date(2024, month, day, hour, minute, 0, 0, time.UTC)
+	}
+
+	tests := []struct {
+		spec string
+		t    time.Time
+		want bool
+	}{
+		{"* * * * *", at(5, 1, 12, 34), true},
+		{"30 4 * * *", at(5, 1, 4, 30), true},
+		{"30 4 * * *", at(5, 1, 4, 31), false},
+		// Ranges and lists.
+		{"0 9-17 * * *", at(5, 1, 17, 0), true},
+		{"0 9-17 * * *", at(5, 1, 18, 0), false},
+		{"0,15,45 * * * *", at(5, 1, 3, 45), true},
+		{"0,15,45 * * * *", at(5, 1, 3, 30), false},
+		// Steps over *, a range and a starting value.
+		{"*/15 * * * *", at(5, 1, 3, 30), true},
+		{"*/15 * * * *", at(5, 1, 3, 31), false},
+		{"0-30/10 * * * *", at(5, 1, 3, 20), true},
+		{"0-30/10 * * * *", at(5, 1, 3, 40), false},
+		{"5/20 * * * *", at(5, 1, 3, 45), true},
+		{"5/20 * * * *", at(5, 1, 3, 40), false},
+		// Month and weekday names, in any case; 7 is Sunday.
+		{"0 0 * MAY *", at(5, 1, 0, 0), true},
+		{"0 0 * jun-aug *", at(5, 1, 0, 0), false},
+		{"0 0 * * mon-fri", at(5, 1, 0, 0), true},
+		{"0 0 * * Sat,Sun", at(5, 1, 0, 0), false},
+		{"0 0 * * 7", at(5, 5, 0, 0), true},
+		// With both day fields restricted either one matching is enough.
+		{"0 0 1 * fri", at(5, 1, 0, 0), true},
+		{"0 0 1 * fri", at(5, 3, 0, 0), true},
+		{"0 0 1 * fri", at(5, 2, 0, 0), false},
+		// With one of them *, only the other counts.
+		{"0 0 1 * *", at(5, 3, 0, 0), false},
+		{"0 0 * * fri", at(5, 1, 0, 0), false},
+		{"0 0 */2 * fri", at(5, 2, 0, 0), false},
+		// Shorthands.
+		{"@hourly", at(5, 1, 7, 0), true},
+		{"@daily", at(5, 1, 7, 0), false},
+		{"@weekly", at(5, 5, 0, 0), true},
+		{"@monthly", at(5, 1, 0, 0), true},
+		{"@yearly", at(5, 1, 0, 0), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.spec+" "+tt.t.Format("Mon Jan 2 15:04"), func(t *testing.T) {
+			c, err := ParseCron(tt.spec)
+			if err != nil {
+				t.Fatalf("ParseCron: %v", err)
+			}
+			if got := c.Matches(tt.t); got != tt.want {
+				t.Errorf("Matches = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,93 @@
+package schedule
+
+import (
+	"context"
+	"log"
+	"strings"
+	"time"
+
+	apiclient "docker-dashboard-agent/client"
+)
+
+// LabelPrefix introduces a schedule label. The rest of the key names the
+// action and the value is a cron expression, e.g.
+// docker-dashboard.schedule.restart="0 3 * * *".
+const LabelPrefix = "docker-dashboard.schedule."
+
+// Scheduler runs actions declared in container labels at the minutes their
+// cron expressions select. It only needs the local inventory, so schedules
+// keep running while the cloud is unreachable.
+type Scheduler struct {
+	inventory func() []apiclient.ContainerSnapshot
+	run       func(ctx context.Context, containerId, action string)
+	location  *time.Location
+
+	// Parsed expressions by label value, and values already reported as
+	// invalid so each is logged once.
+	parsed  map[string]*Cron
+	invalid map[string]bool
+}
+
+// NewScheduler returns a Scheduler that reads containers from inventory and
+// starts due actions with run. Expressions are evaluated in location.
+func NewScheduler(inventory func() []apiclient.ContainerSnapshot, run func(ctx context.Context, containerId, action string), location *time.Location) *Scheduler {
+	return &Scheduler{
+		inventory: inventory,
+		run:       run,
+		location:  location,
+		parsed:    make(map[string]*Cron),
+		invalid:   make(map[string]bool),
+	}
+}
+
+// Run checks schedules at the start of every minute until ctx is done.
+func (s *Scheduler) Run(ctx context.Context) {
+	for {
+		now := time.Now()
+		next := now.Truncate(time.Minute).Add(time.Minute)
+		timer := time.NewTimer(next.Sub(now))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		s.tick(ctx, next)
+	}
+}
+
+func (s *Scheduler) tick(ctx context.Context, minute time.Time) {
+	minute = minute.In(s.location)
+	for _, c := range s.inventory() {
+		for key, value := range c.Labels {
+			if !strings.HasPrefix(key, LabelPrefix) {
+				continue
+			}
+			spec, _ := value.(string)
+			cron := s.cron(c.Name, key, spec)
+			if cron == nil || !cron.Matches(minute) {
+				continue
+			}
+			action := strings.ToUpper(strings.TrimPrefix(key, LabelPrefix))
+			log.Printf("Running scheduled %s for container %s (%s)", action, c.Name, spec)
+			go s.run(ctx, c.DockerId, action)
+		}
+	}
+}
+
+func (s *Scheduler) cron(containerName, key, spec string) *Cron {
+	if cron, ok := s.parsed[spec]; ok {
+		return cron
+	}
+	if s.invalid[spec] {
+		return nil
+	}
+	cron, err := ParseCron(spec)
+	if err != nil {
+		log.Printf("Ignoring label %s on container %s: %v", key, containerName, err)
+		s.invalid[spec] = true
+		return nil
+	}
+	s.parsed[spec] = cron
+	return cron
+}
@@ -0,0 +1,157 @@
+package signing
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	apiclient "docker-dashboard-agent/client"
+)
+
+// Verifier checks Ed25519 signatures on action envelopes. An envelope is
+// accepted when its signature verifies against any configured key, its
+// timestamp is within the allowed window of the agent's clock, and its
+// nonce has not been seen within that window.
+type Verifier struct {
+	keys   []ed25519.PublicKey
+	window time.Duration
+
+	mu     sync.Mutex
+	nonces map[string]time.Time // nonce -> when it may be forgotten
+}
+
+// NewVerifier parses base64-encoded 32-byte Ed25519 public keys. window is
+// the maximum difference between an envelope's timestamp and now, in either
+// direction.
+func NewVerifier(publicKeys []string, window time.Duration) (*Verifier, error) {
+	if len(publicKeys) == 0 {
+		return nil, fmt.Errorf("at least one public key is required")
+	}
+	v := &Verifier{
+		window: window,
+		nonces: make(map[string]time.Time),
+	}
+	for i, encoded := range publicKeys {
+		raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+		if err != nil {
+			return nil, fmt.Errorf("public key %d is not valid base64: %w", i+1, err)
+		}
+		if len(raw) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("public key %d is %d bytes, want %d", i+1, len(raw), ed25519.PublicKeySize)
+		}
+		v.keys = append(v.keys, ed25519.PublicKey(raw))
+	}
+	return v, nil
+}
+
+// Verify returns an error describing why req must not be executed, or nil.
+// It is Authenticate followed by Consume.
+func (v *Verifier) Verify(req apiclient.ActionRequest) error {
+	if err := v.Authenticate(req); err != nil {
+		return err
+	}
+	return v.Consume(req)
+}
+
+// Authenticate checks req's signature and timestamp without recording its
+// nonce, so a redelivered envelope can still be matched to the result of
+// its first delivery.
+func (v *Verifier) Authenticate(req apiclient.ActionRequest) error {
+	if req.Signature == "" {
+		return fmt.Errorf("action is not signed")
+	}
+	if req.Nonce == "" {
+		return fmt.Errorf("signed action has no nonce")
+	}
+	signedAt, err := time.Parse(time.RFC3339Nano, req.Timestamp)
+	if err != nil {
+		return fmt.Errorf("invalid signature timestamp %q", req.Timestamp)
+	}
+	if skew := time.Since(signedAt); skew > v.window || skew < -v.window {
+		return fmt.Errorf("signature timestamp %s is outside the allowed window of %s", req.Timestamp, v.window)
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(req.Signature)
+	if err != nil {
+		return fmt.Errorf("signature is not valid base64")
+	}
+	payload := Payload(req)
+	for _, key := range v.keys {
+		if ed25519.Verify(key, payload, signature) {
+			return nil
+		}
+	}
+	return fmt.Errorf("signature does not match any trusted key")
+}
+
+// Consume records req's nonce and fails if it was already used. It must only
+// be called for envelopes that passed Authenticate, so forged envelopes
+// cannot burn nonces of genuine ones.
+func (v *Verifier) Consume(req apiclient.ActionRequest) error {
+	signedAt, err := time.Parse(time.RFC3339Nano, req.Timestamp)
+	if err != nil {
+		return fmt.Errorf("invalid signature timestamp %q", req.Timestamp)
+	}
+
+	now := time.Now()
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	for nonce, expires := range v.nonces {
+		if now.After(expires) {
+			delete(v.nonces, nonce)
+		}
+	}
+	if _, seen := v.nonces[req.Nonce]; seen {
+		return fmt.Errorf("nonce %s was already used", req.Nonce)
+	}
+	// Any replay later than this would fail the timestamp check anyway.
+	v.nonces[req.Nonce] = signedAt.Add(v.window)
+	return nil
+}
+
+// Payload returns the bytes that are signed for req: the "dd-action-v1"
+// header followed by one field per line, with expires_at normalized to UTC
+// RFC 3339 and params replaced by the hex SHA-256 of its exact JSON text
+// (empty when absent):
+//
+//	dd-action-v1
+//	<version>
+//	<action_id>
+//	<idempotency_key>
+//	<action>
+//	<containerId>
+//	<project>
+//	<expires_at>
+//	<timestamp>
+//	<nonce>
+//	<sha256(params)>
+func Payload(req apiclient.ActionRequest) []byte {
+	expiresAt := ""
+	if req.ExpiresAt != nil {
+		expiresAt = req.ExpiresAt.UTC().Format(time.RFC3339Nano)
+	}
+	paramsHash := ""
+	if len(req.Params) > 0 {
+		sum := sha256.Sum256(req.Params)
+		paramsHash = hex.EncodeToString(sum[:])
+	}
+	return []byte(strings.Join([]string{
+		"dd-action-v1",
+		strconv.Itoa(req.Version),
+		req.ActionId,
+		req.IdempotencyKey,
+		req.Action,
+		req.ContainerId,
+		req.Project,
+		expiresAt,
+		req.Timestamp,
+		req.Nonce,
+		paramsHash,
+	}, "\n"))
+}
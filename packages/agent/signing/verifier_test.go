@@ -0,0 +1,243 @@
+package signing
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	apiclient "docker-dashboard-agent/client"
+)
+
+const testWindow = 5 * time.Minute
+
+func testKey(seed byte) ed25519.PrivateKey {
+	return ed25519.NewKeyFromSeed(bytes.Repeat([]byte{seed}, ed25519.SeedSize))
+}
+
+func newTestVerifier(t *testing.T, keys ...ed25519.PrivateKey) *Verifier {
+	t.Helper()
+	var encoded []string
+	for _, key := range keys {
+		encoded = append(encoded, base64.StdEncoding.EncodeToString(key.Public().(ed25519.PublicKey)))
+	}
+	v, err := NewVerifier(encoded, testWindow)
+	if err != nil {
+		t.Fatalf("NewVerifier: %v", err)
+	}
+	return v
+}
+
+func signedRequest(key ed25519.PrivateKey, signedAt time.Time, nonce string) apiclient.ActionRequest {
+	req := apiclient.ActionRequest{
+		Version:     1,
+		ActionId:    "act-1",
+		Action:      "RESTART",
+		ContainerId: "abc123",
+		Params:      json.RawMessage(`{"timeout": 5}`),
+		Timestamp:   signedAt.UTC().Format(time.RFC3339Nano),
+		Nonce:       nonce,
+	}
+	req.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(key, Payload(req)))
+	return req
+}
+
+func TestPayload(t *testing.T) {
+	expires := time.Date(2024, 5, 1, 14, 0, 0, 0, time.FixedZone("CEST", 2*60*60))
+	req := apiclient.ActionRequest{
+		Version:        1,
+		ActionId:       "act-1",
+		IdempotencyKey: "key-1",
+		Action:         "STOP",
+		ContainerId:    "abc123",
+		Params:         json.RawMessage(`{"timeout": 5}`),
+		ExpiresAt:      &expires,
+		Timestamp:      "2024-05-01T11:59:00Z",
+		Nonce:          "n-1",
+		Signature:      "ignored",
+	}
+
+	tests := []struct {
+		name   string
+		modify func(*apiclient.ActionRequest)
+		want   string
+	}{
+		{
+			name:   "all fields",
+			modify: func(*apiclient.ActionRequest) {},
+			want: "dd-action-v1\n1\nact-1\nkey-1\nSTOP\nabc123\n\n2024-05-01T12:00:00Z\n2024-05-01T11:59:00Z\nn-1\n" +
+				"e71a76f7c7f35d651cf6948aebb094b7f6ee92525fce6269313b92f93316f6df",
+		},
+		{
+			name: "absent optional fields are empty lines",
+			modify: func(r *apiclient.ActionRequest) {
+				r.IdempotencyKey = ""
+				r.ContainerId = ""
+				r.Project = "shop"
+				r.ExpiresAt = nil
+				r.Params = nil
+			},
+			want: "dd-action-v1\n1\nact-1\n\nSTOP\n\nshop\n\n2024-05-01T11:59:00Z\nn-1\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := req
+			tt.modify(&r)
+			if got := string(Payload(r)); got != tt.want {
+				t.Errorf("Payload =\n%q\nwant\n%q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	trusted := testKey(1)
+	other := testKey(2)
+	v := newTestVerifier(t, testKey(3), trusted)
+	now := time.Now()
+
+	tests := []struct {
+		name    string
+		req     func() apiclient.ActionRequest
+		wantErr string
+	}{
+		{
+			name: "valid",
+			req:  func() apiclient.ActionRequest { return signedRequest(trusted, now, "n") },
+		},
+		{
+			name: "slightly in the future",
+			req:  func() apiclient.ActionRequest { return signedRequest(trusted, now.Add(testWindow-time.Minute), "n") },
+		},
+		{
+			name:    "too old",
+			req:     func() apiclient.ActionRequest { return signedRequest(trusted, now.Add(-testWindow-time.Minute), "n") },
+			wantErr: "outside the allowed window",
+		},
+		{
+			name:    "too far in the future",
+			req:     func() apiclient.ActionRequest { return signedRequest(trusted, now.Add(testWindow+time.Minute), "n") },
+			wantErr: "outside the allowed window",
+		},
+		{
+			name:    "untrusted key",
+			req:     func() apiclient.ActionRequest { return signedRequest(other, now, "n") },
+			wantErr: "does not match any trusted key",
+		},
+		{
+			name: "tampered field",
+			req: func() apiclient.ActionRequest {
+				r := signedRequest(trusted, now, "n")
+				r.ContainerId = "def456"
+				return r
+			},
+			wantErr: "does not match any trusted key",
+		},
+		{
+			name: "tampered params",
+			req: func() apiclient.ActionRequest {
+				r := signedRequest(trusted, now, "n")
+				r.Params = json.RawMessage(`{"timeout":5}`)
+				return r
+			},
+			wantErr: "does not match any trusted key",
+		},
+		{
+			name: "unsigned",
+			req: func() apiclient.ActionRequest {
+				r := signedRequest(trusted, now, "n")
+				r.Signature = ""
+				return r
+			},
+			wantErr: "not signed",
+		},
+		{
+			name:    "no nonce",
+			req:     func() apiclient.ActionRequest { return signedRequest(trusted, now, "") },
+			wantErr: "no nonce",
+		},
+		{
+			name: "bad timestamp",
+			req: func() apiclient.ActionRequest {
+				r := signedRequest(trusted, now, "n")
+				r.Timestamp = "yesterday"
+				return r
+			},
+			wantErr: "invalid signature timestamp",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := v.Authenticate(tt.req())
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Errorf("Authenticate: %v", err)
+			case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+				t.Errorf("Authenticate error = %v, want one containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestVerifyRejectsReplayedNonce(t *testing.T) {
+	key := testKey(1)
+	v := newTestVerifier(t, key)
+	now := time.Now()
+
+	first := signedRequest(key, now, "n-1")
+	if err := v.Verify(first); err != nil {
+		t.Fatalf("first Verify: %v", err)
+	}
+	if err := v.Verify(first); err == nil || !strings.Contains(err.Error(), "already used") {
+		t.Errorf("replayed Verify error = %v", err)
+	}
+	// Authenticating alone leaves the nonce untouched, so redeliveries can
+	// still be matched to their first execution.
+	if err := v.Authenticate(first); err != nil {
+		t.Errorf("Authenticate after Verify: %v", err)
+	}
+	if err := v.Verify(signedRequest(key, now, "n-2")); err != nil {
+		t.Errorf("Verify with a fresh nonce: %v", err)
+	}
+}
+
+func TestConsumeForgetsExpiredNonces(t *testing.T) {
+	key := testKey(1)
+	v := newTestVerifier(t, key)
+
+	// Signed long enough ago that its nonce is past the window already.
+	old := signedRequest(key, time.Now().Add(-2*testWindow), "n-1")
+	if err := v.Consume(old); err != nil {
+		t.Fatalf("Consume: %v", err)
+	}
+	if err := v.Consume(signedRequest(key, time.Now(), "n-2")); err != nil {
+		t.Fatalf("Consume: %v", err)
+	}
+	v.mu.Lock()
+	_, kept := v.nonces["n-1"]
+	v.mu.Unlock()
+	if kept {
+		t.Errorf("nonce past the window was not pruned")
+	}
+}
+
+func TestNewVerifierRejectsBadKeys(t *testing.T) {
+	tests := map[string][]string{
+		"no keys":    nil,
+		"not base64": {"not base64!"},
+		"wrong size": {base64.StdEncoding.EncodeToString([]byte("short"))},
+	}
+	for name, keys := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := NewVerifier(keys, testWindow); err == nil {
+				t.Errorf("NewVerifier accepted %q", keys)
+			}
+		})
+	}
+}
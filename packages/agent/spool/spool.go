@@ -0,0 +1,234 @@
+package spool
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const segmentExt = ".seg"
+
+// Spool is a durable FIFO of JSON payloads kept in segment files under a
+// directory. When the total size exceeds the cap, whole segments are evicted
+// oldest first, so an extended outage loses the oldest data rather than the
+// newest.
+type Spool struct {
+	dir          string
+	maxBytes     int64
+	segmentBytes int64
+
+	mu         sync.Mutex
+	segments   []segment // oldest first; the last one may be the active segment
+	active     *os.File
+	totalBytes int64
+}
+
+type segment struct {
+	seq  uint64
+	size int64
+}
+
+type record struct {
+	SpooledAt time.Time       `json:"spooledAt"`
+	Payload   json.RawMessage `json:"payload"`
+}
+
+// Open loads any segments left in dir by a previous run. New records always
+// go to a fresh segment.
+func Open(dir string, maxBytes, segmentBytes int64) (*Spool, error) {
+	if maxBytes <= 0 || segmentBytes <= 0 || segmentBytes > maxBytes {
+		return nil, fmt.Errorf("invalid spool sizes: max %d, segment %d", maxBytes, segmentBytes)
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create spool directory: %w", err)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read spool directory: %w", err)
+	}
+
+	s := &Spool{dir: dir, maxBytes: maxBytes, segmentBytes: segmentBytes}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, segmentExt) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, segmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil, fmt.Errorf("failed to stat spool segment %s: %w", name, err)
+		}
+		s.segments = append(s.segments, segment{seq: seq, size: info.Size()})
+		s.totalBytes += info.Size()
+	}
+	sort.Slice(s.segments, func(i, j int) bool { return s.segments[i].seq < s.segments[j].seq })
+
+	return s, nil
+}
+
+// Size returns the number of bytes currently spooled.
+func (s *Spool) Size() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.totalBytes
+}
+
+// Append stores payload, which must be a single JSON value.
+func (s *Spool) Append(payload []byte) error {
+	line, err := json.Marshal(record{SpooledAt: time.Now().UTC(), Payload: payload})
+	if err != nil {
+		return fmt.Errorf("failed to encode spool record: %w", err)
+	}
+	line = append(line, '\n')
+	if int64(len(line)) > s.segmentBytes {
+		return fmt.Errorf("spool record of %d bytes exceeds segment size %d", len(line), s.segmentBytes)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.active == nil || s.segments[len(s.segments)-1].size+int64(len(line)) > s.segmentBytes {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+
+	if _, err := s.active.Write(line); err != nil {
+		return fmt.Errorf("failed to write spool record: %w", err)
+	}
+	s.segments[len(s.segments)-1].size += int64(len(line))
+	s.totalBytes += int64(len(line))
+
+	s.evict()
+	return nil
+}
+
+// rotate closes the active segment and starts a new one. Callers hold mu.
+func (s *Spool) rotate() error {
+	if s.active != nil {
+		s.active.Close()
+		s.active = nil
+	}
+
+	var seq uint64 = 1
+	if len(s.segments) > 0 {
+		seq = s.segments[len(s.segments)-1].seq + 1
+	}
+
+	f, err := os.OpenFile(s.path(seq), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to create spool segment: %w", err)
+	}
+	s.active = f
+	s.segments = append(s.segments, segment{seq: seq})
+	return nil
+}
+
+// evict drops the oldest sealed segments until the spool fits its cap.
+// Callers hold mu.
+func (s *Spool) evict() {
+	for s.totalBytes > s.maxBytes && len(s.segments) > 1 {
+		oldest := s.segments[0]
+		if err := os.Remove(s.path(oldest.seq)); err != nil && !os.IsNotExist(err) {
+			log.Printf("Failed to evict spool segment %d: %v", oldest.seq, err)
+		}
+		s.segments = s.segments[1:]
+		s.totalBytes -= oldest.size
+		log.Printf("Spool exceeded %d bytes; dropped oldest segment (%d bytes)", s.maxBytes, oldest.size)
+	}
+}
+
+// Replay hands every spooled payload to fn in the order it was appended,
+// deleting each segment once all of its records were accepted. If fn returns
+// an error, replay stops and the unsent records stay spooled for next time.
+func (s *Spool) Replay(fn func(payload []byte, spooledAt time.Time) error) error {
+	for {
+		s.mu.Lock()
+		if len(s.segments) == 0 {
+			s.mu.Unlock()
+			return nil
+		}
+		seg := s.segments[0]
+		if len(s.segments) == 1 && s.active != nil {
+			// Seal the active segment so appends made during replay land in
+			// a new one instead of the file being read.
+			s.active.Close()
+			s.active = nil
+		}
+		s.mu.Unlock()
+
+		if err := s.replaySegment(seg, fn); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *Spool) replaySegment(seg segment, fn func(payload []byte, spooledAt time.Time) error) error {
+	data, err := os.ReadFile(s.path(seg.seq))
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read spool segment: %w", err)
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 64*1024), int(s.segmentBytes)+1)
+	var offset int64
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		var rec record
+		if err := json.Unmarshal(line, &rec); err != nil {
+			// Most likely a record torn by a crash mid-write.
+			log.Printf("Skipping unreadable spool record in segment %d: %v", seg.seq, err)
+		} else if err := fn(rec.Payload, rec.SpooledAt); err != nil {
+			s.truncateFront(seg, data[offset:])
+			return err
+		}
+		offset += int64(len(line)) + 1
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.segments) > 0 && s.segments[0].seq == seg.seq {
+		os.Remove(s.path(seg.seq))
+		s.totalBytes -= s.segments[0].size
+		s.segments = s.segments[1:]
+	}
+	return nil
+}
+
+// truncateFront rewrites seg so it only holds the unsent remainder.
+func (s *Spool) truncateFront(seg segment, remainder []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.segments) == 0 || s.segments[0].seq != seg.seq {
+		return // evicted while we were replaying it
+	}
+
+	tmp := s.path(seg.seq) + ".tmp"
+	if err := os.WriteFile(tmp, remainder, 0o600); err != nil {
+		log.Printf("Failed to rewrite spool segment %d: %v", seg.seq, err)
+		return
+	}
+	if err := os.Rename(tmp, s.path(seg.seq)); err != nil {
+		log.Printf("Failed to rewrite spool segment %d: %v", seg.seq, err)
+		return
+	}
+	s.totalBytes -= s.segments[0].size - int64(len(remainder))
+	s.segments[0].size = int64(len(remainder))
+}
+
+func (s *Spool) path(seq uint64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%020d%s", seq, segmentExt))
+}
@@ -0,0 +1,237 @@
+package spool
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The sizes below rely on every record taking 150 to 160 bytes on disk
+// (the timestamp's fraction varies), so a 400 byte segment holds exactly
+// two records and a 700 byte cap holds four.
+const (
+	testSegmentBytes = 400
+	testMaxBytes     = 700
+)
+
+// payload returns the i-th test payload, a JSON string of 100 characters.
+func payload(i int) string {
+	return fmt.Sprintf("%q", fmt.Sprintf("%03d%s", i, strings.Repeat("x", 97)))
+}
+
+func payloads(from, to int) []string {
+	var out []string
+	for i := from; i < to; i++ {
+		out = append(out, payload(i))
+	}
+	return out
+}
+
+func appendAll(t *testing.T, s *Spool, from, to int) {
+	t.Helper()
+	for i := from; i < to; i++ {
+		if err := s.Append([]byte(payload(i))); err != nil {
+			t.Fatalf("Append(%d): %v", i, err)
+		}
+	}
+}
+
+// replayAll replays s and returns the payloads it was handed.
+func replayAll(t *testing.T, s *Spool) []string {
+	t.Helper()
+	var got []string
+	err := s.Replay(func(p []byte, _ time.Time) error {
+		got = append(got, string(p))
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Replay: %v", err)
+	}
+	return got
+}
+
+// diskBytes returns the number of segment files in dir and their total size.
+func diskBytes(t *testing.T, dir string) (int, int64) {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("read spool directory: %v", err)
+	}
+	var n int
+	var size int64
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), segmentExt) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			t.Fatalf("stat %s: %v", entry.Name(), err)
+		}
+		n++
+		size += info.Size()
+	}
+	return n, size
+}
+
+func TestOpenRejectsInvalidSizes(t *testing.T) {
+	tests := []struct {
+		maxBytes, segmentBytes int64
+	}{
+		{0, 100},
+		{100, 0},
+		{100, 200},
+	}
+	for _, tt := range tests {
+		if _, err := Open(t.TempDir(), tt.maxBytes, tt.segmentBytes); err == nil {
+			t.Errorf("Open(max %d, segment %d) succeeded", tt.maxBytes, tt.segmentBytes)
+		}
+	}
+}
+
+func TestSpoolReplayOrder(t *testing.T) {
+	dir := t.TempDir()
+	s, err := Open(dir, 1<<20, testSegmentBytes)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	appendAll(t, s, 0, 5)
+
+	segments, size := diskBytes(t, dir)
+	if segments != 3 || s.Size() != size {
+		t.Errorf("after 5 appends: %d segments, Size %d, %d bytes on disk; want 3 segments", segments, s.Size(), size)
+	}
+	if got, want := replayAll(t, s), payloads(0, 5); !reflect.DeepEqual(got, want) {
+		t.Errorf("Replay = %q, want %q", got, want)
+	}
+	if segments, _ := diskBytes(t, dir); segments != 0 || s.Size() != 0 {
+		t.Errorf("after replay: %d segments, Size %d", segments, s.Size())
+	}
+}
+
+func TestSpoolEvictsOldestSegments(t *testing.T) {
+	dir := t.TempDir()
+	s, err := Open(dir, testMaxBytes, testSegmentBytes)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+
+	// Four records fit; the fifth starts a third segment and pushes the
+	// first one out, and the seventh does the same to the second.
+	appendAll(t, s, 0, 7)
+
+	segments, size := diskBytes(t, dir)
+	if segments != 2 || s.Size() != size || size > testMaxBytes {
+		t.Errorf("after 7 appends: %d segments, Size %d, %d bytes on disk; want 2 segments within %d bytes", segments, s.Size(), size, testMaxBytes)
+	}
+	if got, want := replayAll(t, s), payloads(4, 7); !reflect.DeepEqual(got, want) {
+		t.Errorf("Replay = %q, want %q", got, want)
+	}
+}
+
+func TestSpoolReplayFailure(t *testing.T) {
+	dir := t.TempDir()
+	s, err := Open(dir, 1<<20, testSegmentBytes)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	appendAll(t, s, 0, 5)
+
+	// Fail on the second record of the second segment.
+	errSend := errors.New("send failed")
+	var got []string
+	err = s.Replay(func(p []byte, _ time.Time) error {
+		if string(p) == payload(3) {
+			return errSend
+		}
+		got = append(got, string(p))
+		return nil
+	})
+	if !errors.Is(err, errSend) {
+		t.Fatalf("Replay error = %v, want %v", err, errSend)
+	}
+	if want := payloads(0, 3); !reflect.DeepEqual(got, want) {
+		t.Errorf("delivered = %q, want %q", got, want)
+	}
+
+	// The first segment is gone and the second only holds the unsent record.
+	segments, size := diskBytes(t, dir)
+	if segments != 2 || s.Size() != size {
+		t.Errorf("after failed replay: %d segments, Size %d, %d bytes on disk; want 2 segments", segments, s.Size(), size)
+	}
+	if got, want := replayAll(t, s), payloads(3, 5); !reflect.DeepEqual(got, want) {
+		t.Errorf("second Replay = %q, want %q", got, want)
+	}
+	if s.Size() != 0 {
+		t.Errorf("Size after second replay = %d, want 0", s.Size())
+	}
+}
+
+func TestSpoolAppendDuringReplay(t *testing.T) {
+	dir := t.TempDir()
+	s, err := Open(dir, 1<<20, testSegmentBytes)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	appendAll(t, s, 0, 1)
+
+	// The record appended while the active segment is being replayed must
+	// land in a new segment rather than being deleted with the old one.
+	var got []string
+	err = s.Replay(func(p []byte, _ time.Time) error {
+		if len(got) == 0 {
+			if err := s.Append([]byte(payload(1))); err != nil {
+				t.Errorf("Append during replay: %v", err)
+			}
+		}
+		got = append(got, string(p))
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Replay: %v", err)
+	}
+	if want := payloads(0, 2); !reflect.DeepEqual(got, want) {
+		t.Errorf("Replay = %q, want %q", got, want)
+	}
+	if segments, _ := diskBytes(t, dir); segments != 0 || s.Size() != 0 {
+		t.Errorf("after replay: %d segments, Size %d", segments, s.Size())
+	}
+}
+
+func TestSpoolReopen(t *testing.T) {
+	dir := t.TempDir()
+	s, err := Open(dir, 1<<20, testSegmentBytes)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	appendAll(t, s, 0, 3)
+
+	// Files that are not segments, such as a rewrite cut short by a crash,
+	// are ignored.
+	for _, name := range []string{"notes.txt", "00000000000000000001" + segmentExt + ".tmp"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("junk\n"), 0o600); err != nil {
+			t.Fatalf("write %s: %v", name, err)
+		}
+	}
+
+	reopened, err := Open(dir, 1<<20, testSegmentBytes)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	if reopened.Size() != s.Size() {
+		t.Errorf("reopened Size = %d, want %d", reopened.Size(), s.Size())
+	}
+
+	// New records go after the leftovers, in a segment of their own.
+	appendAll(t, reopened, 3, 4)
+	if segments, _ := diskBytes(t, dir); segments != 3 {
+		t.Errorf("after reopening and appending: %d segments, want 3", segments)
+	}
+	if got, want := replayAll(t, reopened), payloads(0, 4); !reflect.DeepEqual(got, want) {
+		t.Errorf("Replay = %q, want %q", got, want)
+	}
+}
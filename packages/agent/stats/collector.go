@@ -0,0 +1,107 @@
+package stats
+
+import (
+	"context"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	apiclient "docker-dashboard-agent/client"
+	"docker-dashboard-agent/docker"
+)
+
+// Collector keeps one streaming stats reader per running container and
+// caches the latest sample from each, so reporting metrics never waits on
+// the Docker API.
+type Collector struct {
+	docker *docker.Client
+	maxAge time.Duration
+
+	mu      sync.Mutex
+	readers map[string]context.CancelFunc
+	latest  map[string]sample
+}
+
+type sample struct {
+	item apiclient.MetricItem
+	at   time.Time
+}
+
+// NewCollector creates a collector whose cached samples are reported for
+// at most maxAge after they were taken.
+func NewCollector(dockerCli *docker.Client, maxAge time.Duration) *Collector {
+	return &Collector{
+		docker:  dockerCli,
+		maxAge:  maxAge,
+		readers: make(map[string]context.CancelFunc),
+		latest:  make(map[string]sample),
+	}
+}
+
+// Sync starts readers for newly running containers and stops readers (and
+// drops cached samples) for containers that are no longer running.
+func (c *Collector) Sync(ctx context.Context, running []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	current := make(map[string]bool, len(running))
+	for _, id := range running {
+		current[id] = true
+		if _, exists := c.readers[id]; !exists {
+			readerCtx, cancel := context.WithCancel(ctx)
+			c.readers[id] = cancel
+			go c.read(readerCtx, id)
+		}
+	}
+
+	for id, cancel := range c.readers {
+		if !current[id] {
+			cancel()
+			delete(c.readers, id)
+			delete(c.latest, id)
+		}
+	}
+}
+
+// Latest returns the freshest sample of every running container.
+func (c *Collector) Latest() []apiclient.MetricItem {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cutoff := time.Now().Add(-c.maxAge)
+	items := make([]apiclient.MetricItem, 0, len(c.latest))
+	for _, s := range c.latest {
+		if s.at.After(cutoff) {
+			items = append(items, s.item)
+		}
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].ContainerId < items[j].ContainerId })
+	return items
+}
+
+func (c *Collector) read(ctx context.Context, containerId string) {
+	for {
+		err := c.docker.StreamContainerStats(ctx, containerId, func(item apiclient.MetricItem) {
+			c.mu.Lock()
+			if _, tracked := c.readers[containerId]; tracked {
+				c.latest[containerId] = sample{item: item, at: time.Now()}
+			}
+			c.mu.Unlock()
+		})
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			log.Printf("Stats stream error for container %s: %v", containerId, err)
+		}
+
+		// The stream also ends when the container stops; Sync cancels us
+		// once the inventory catches up, until then retry slowly.
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(2 * time.Second):
+		}
+	}
+}
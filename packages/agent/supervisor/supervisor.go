@@ -0,0 +1,305 @@
+package supervisor
+
+import (
+	"context"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	apiclient "docker-dashboard-agent/client"
+	"docker-dashboard-agent/docker"
+	"github.com/docker/docker/api/types/events"
+)
+
+// supervisedEvents are the container events the supervisor reacts to.
+var supervisedEvents = []string{"start", "kill", "die", "stop", "destroy", "health_status"}
+
+// reloadSignals are signals commonly sent to make a process reload or
+// report rather than exit, by number as in kill events: SIGHUP, SIGUSR1,
+// SIGUSR2 and SIGWINCH.
+var reloadSignals = map[string]bool{"1": true, "10": true, "12": true, "28": true}
+
+// stopGrace is how long after a die event a stop event may still arrive.
+// Docker emits die then stop when a container is stopped through the API,
+// and kill then die when it is killed, so a die with neither is an
+// unexpected exit.
+const stopGrace = 2 * time.Second
+
+// Options configures a Supervisor.
+type Options struct {
+	// Label selects the containers to supervise; any value other than
+	// "false" counts.
+	Label string
+	// Restart delays grow from BackoffMin, doubling per attempt, up to
+	// BackoffMax.
+	BackoffMin time.Duration
+	BackoffMax time.Duration
+	// MaxAttempts consecutive failed recoveries open the circuit breaker,
+	// after which the container is left alone until it has been started by
+	// someone else and stayed up for ResetAfter.
+	MaxAttempts int
+	ResetAfter  time.Duration
+}
+
+// Supervisor restarts managed containers that exit unexpectedly or turn
+// unhealthy, and reports every intervention through report.
+type Supervisor struct {
+	docker *docker.Client
+	opts   Options
+	report func(apiclient.SupervisorEvent)
+
+	mu         sync.Mutex
+	containers map[string]*tracked
+}
+
+type tracked struct {
+	name      string
+	attempts  int
+	lastStart time.Time
+	tripped   bool
+
+	// stopped is set by a stop event and cleared by start.
+	stopped bool
+	// killed is set by a kill event, e.g. from `docker kill` or a KILL
+	// action, and cleared by start. The die that follows is intentional.
+	killed bool
+	// pending is the scheduled die check or restart, if any.
+	pending *time.Timer
+}
+
+func New(dockerCli *docker.Client, opts Options, report func(apiclient.SupervisorEvent)) *Supervisor {
+	return &Supervisor{
+		docker:     dockerCli,
+		opts:       opts,
+		report:     report,
+		containers: make(map[string]*tracked),
+	}
+}
+
+// Run watches Docker events until ctx is cancelled, reconnecting to the
+// events stream when it drops.
+func (s *Supervisor) Run(ctx context.Context) {
+	for ctx.Err() == nil {
+		s.watch(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(5 * time.Second):
+		}
+	}
+}
+
+func (s *Supervisor) watch(ctx context.Context) {
+	watchCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	messages, errs := s.docker.ContainerEvents(watchCtx, supervisedEvents...)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case err := <-errs:
+			if ctx.Err() == nil {
+				log.Printf("Supervisor events stream ended: %v", err)
+			}
+			return
+		case msg := <-messages:
+			if s.managed(msg.Actor.Attributes) {
+				s.handle(ctx, msg)
+			}
+		}
+	}
+}
+
+func (s *Supervisor) managed(attributes map[string]string) bool {
+	value, ok := attributes[s.opts.Label]
+	return ok && !strings.EqualFold(value, "false")
+}
+
+func (s *Supervisor) handle(ctx context.Context, msg events.Message) {
+	id := msg.Actor.ID
+	action := string(msg.Action)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, ok := s.containers[id]
+	if !ok {
+		if action == "destroy" {
+			return
+		}
+		t = &tracked{}
+		s.containers[id] = t
+	}
+	if name := msg.Actor.Attributes["name"]; name != "" {
+		t.name = name
+	}
+
+	switch {
+	case action == "start":
+		// Whoever started it, e.g. Docker's own restart policy, already
+		// recovered the container.
+		t.cancelPending()
+		t.stopped = false
+		t.killed = false
+		t.lastStart = time.Now()
+	case action == "kill":
+		if !reloadSignals[msg.Actor.Attributes["signal"]] {
+			t.killed = true
+		}
+	case action == "stop":
+		t.stopped = true
+		t.cancelPending()
+	case action == "destroy":
+		t.cancelPending()
+		delete(s.containers, id)
+	case action == "die":
+		exitCode, err := strconv.Atoi(msg.Actor.Attributes["exitCode"])
+		var code *int
+		if err == nil {
+			code = &exitCode
+		}
+		t.cancelPending()
+		if t.killed {
+			t.stopped = true
+			return
+		}
+		t.pending = time.AfterFunc(stopGrace, func() {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			if !t.stopped && s.containers[id] == t {
+				s.failure(ctx, id, t, "exited", code)
+			}
+		})
+	case strings.HasPrefix(action, "health_status") && strings.HasSuffix(action, "unhealthy"):
+		s.failure(ctx, id, t, "unhealthy", nil)
+	}
+}
+
+// failure schedules a recovery for the container, or opens the circuit
+// breaker once MaxAttempts recoveries in a row have not kept it up. The
+// caller must hold s.mu.
+func (s *Supervisor) failure(ctx context.Context, id string, t *tracked, reason string, exitCode *int) {
+	// A container that stayed up long enough since the last start has
+	// recovered; start counting afresh. The uptime only counts once, so
+	// failed restarts that follow still count towards MaxAttempts.
+	if !t.lastStart.IsZero() && time.Since(t.lastStart) >= s.opts.ResetAfter {
+		t.attempts = 0
+		t.tripped = false
+		t.lastStart = time.Time{}
+	}
+	if t.tripped {
+		return
+	}
+	event := apiclient.SupervisorEvent{
+		ContainerId:   id,
+		ContainerName: t.name,
+		Reason:        reason,
+		ExitCode:      exitCode,
+		Attempt:       t.attempts + 1,
+		MaxAttempts:   s.opts.MaxAttempts,
+	}
+	if t.attempts >= s.opts.MaxAttempts {
+		t.tripped = true
+		event.Event = "circuit_open"
+		event.Attempt = t.attempts
+		log.Printf("Supervisor: giving up on container %s after %d restart attempts", t.name, t.attempts)
+		s.emit(event)
+		return
+	}
+
+	delay := s.opts.BackoffMin << uint(t.attempts)
+	if delay > s.opts.BackoffMax || delay <= 0 {
+		delay = s.opts.BackoffMax
+	}
+	t.attempts++
+	event.Event = "restart_scheduled"
+	event.DelayMs = delay.Milliseconds()
+	log.Printf("Supervisor: container %s %s; restart %d/%d in %s", t.name, reason, t.attempts, s.opts.MaxAttempts, delay)
+	s.emit(event)
+
+	t.cancelPending()
+	t.pending = time.AfterFunc(delay, func() {
+		s.recover(ctx, id, event)
+	})
+}
+
+// recover restarts the container unless it no longer needs it, e.g. because
+// Docker's own restart policy already brought it back.
+func (s *Supervisor) recover(ctx context.Context, id string, scheduled apiclient.SupervisorEvent) {
+	if ctx.Err() != nil {
+		return
+	}
+	s.mu.Lock()
+	t, ok := s.containers[id]
+	stopped := ok && t.stopped
+	var started time.Time
+	if ok {
+		started = t.lastStart
+	}
+	s.mu.Unlock()
+	if !ok || stopped {
+		return
+	}
+
+	event := scheduled
+	event.DelayMs = 0
+
+	state, err := s.docker.ContainerState(ctx, id)
+	switch {
+	case err != nil:
+		event.Event = "restart_failed"
+		event.Error = err.Error()
+	case state == "removed":
+		return
+	case scheduled.Reason == "exited" && state == "running":
+		event.Event = "restart_skipped"
+	case scheduled.Reason == "exited":
+		err = s.docker.StartContainer(ctx, id)
+	default:
+		err = s.docker.RestartContainer(ctx, id, nil)
+	}
+	if event.Event == "" {
+		if err != nil {
+			event.Event = "restart_failed"
+			event.Error = err.Error()
+		} else {
+			event.Event = "restarted"
+		}
+	}
+
+	if event.Error != "" {
+		log.Printf("Supervisor: failed to restart container %s: %s", scheduled.ContainerName, event.Error)
+	} else {
+		log.Printf("Supervisor: %s container %s", strings.ReplaceAll(event.Event, "_", " "), scheduled.ContainerName)
+	}
+	s.emit(event)
+
+	if event.Event != "restart_failed" {
+		return
+	}
+	// Try again with the next backoff, unless the container was stopped,
+	// removed or started by someone else in the meantime.
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.containers[id] == t && !t.stopped && t.lastStart.Equal(started) {
+		s.failure(ctx, id, t, scheduled.Reason, scheduled.ExitCode)
+	}
+}
+
+func (s *Supervisor) emit(event apiclient.SupervisorEvent) {
+	event.Timestamp = time.Now().UTC().Format(time.RFC3339Nano)
+	if s.report != nil {
+		s.report(event)
+	}
+}
+
+func (t *tracked) cancelPending() {
+	if t.pending != nil {
+		t.pending.Stop()
+		t.pending = nil
+	}
+}